@@ -0,0 +1,245 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package certfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Options control the safety checks applied when loading a key pair
+type Options struct {
+	CheckPermissions bool   // refuse private keys readable by others or owned by an unexpected user
+	KeyOwner         string // expected owner of the private key, a user name or uid
+}
+
+// Bundle holds the certificate and private key bytes exactly as they were
+// validated, these are the bytes that get uploaded to TrueNAS.
+type Bundle struct {
+	Source       string // where the certificate and key were read from
+	CertPath     string // configured certificate path
+	KeyPath      string // configured private key path
+	CertResolved string // certificate path after resolving symlinks
+	KeyResolved  string // private key path after resolving symlinks
+	Certificate  []byte // pem encoded certificate chain
+	PrivateKey   []byte // pem encoded private key
+	certSum      [sha256.Size]byte
+	keySum       [sha256.Size]byte
+	reload       func() ([]byte, []byte, error) // re-reads the certificate and key from the source
+}
+
+func newBundle(source string, certPem []byte, keyPem []byte, reload func() ([]byte, []byte, error)) *Bundle {
+	return &Bundle{
+		Source:      source,
+		Certificate: certPem,
+		PrivateKey:  keyPem,
+		certSum:     sha256.Sum256(certPem),
+		keySum:      sha256.Sum256(keyPem),
+		reload:      reload,
+	}
+}
+
+// NewBundle returns a Bundle for a certificate and key held only in memory,
+// there is nothing to re-read so CheckUnchanged always succeeds.
+func NewBundle(source string, certPem []byte, keyPem []byte) *Bundle {
+	return newBundle(source, certPem, keyPem, nil)
+}
+
+// NewBundleFunc returns a Bundle whose CheckUnchanged compares the certificate
+// and key against the pair returned by reload.
+func NewBundleFunc(source string, certPem []byte, keyPem []byte, reload func() ([]byte, []byte, error)) *Bundle {
+	return newBundle(source, certPem, keyPem, reload)
+}
+
+// SplitPEM separates the certificates from the private key in a single pem
+// stream, as printed by a password manager or served by a distribution endpoint.
+func SplitPEM(data []byte) ([]byte, []byte, error) {
+	var certPem, keyPem []byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			certPem = append(certPem, pem.EncodeToMemory(block)...)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			if keyPem != nil {
+				return nil, nil, fmt.Errorf("more than one private key found")
+			}
+			keyPem = pem.EncodeToMemory(block)
+		}
+	}
+	if certPem == nil {
+		return nil, nil, fmt.Errorf("no pem encoded certificate found")
+	}
+	if keyPem == nil {
+		return nil, nil, fmt.Errorf("no pem encoded private key found")
+	}
+	return certPem, keyPem, nil
+}
+
+// Load reads the certificate and private key, applying the permission
+// checks in opts to the private key, and records a hash of both files.
+func Load(certPath string, keyPath string, opts Options) (*Bundle, error) {
+	certResolved, err := resolve(certPath, "certificate")
+	if err != nil {
+		return nil, err
+	}
+	keyResolved, err := resolve(keyPath, "private key")
+	if err != nil {
+		return nil, err
+	}
+
+	certPem, err := os.ReadFile(certResolved)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the pem encoded certificate, %v", err)
+	}
+	keyPem, err := readKey(keyResolved, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// re-read through the configured paths, a symlink swapped by a renewal is detected too
+	b := newBundle(certPath, certPem, keyPem, func() ([]byte, []byte, error) {
+		certPem, err := os.ReadFile(certPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not re-read the certificate, %v", err)
+		}
+		keyPem, err := os.ReadFile(keyPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not re-read the private key, %v", err)
+		}
+		return certPem, keyPem, nil
+	})
+	b.CertPath, b.KeyPath = certPath, keyPath
+	b.CertResolved, b.KeyResolved = certResolved, keyResolved
+
+	return b, nil
+}
+
+// Verify checks that the certificate and private key can be parsed and that they match
+func (b *Bundle) Verify() error {
+	cert, err := tls.X509KeyPair(b.Certificate, b.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("X509KeyPair error: %v", err)
+	}
+	_, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("ParseCertificate error: %v", err)
+	}
+	return nil
+}
+
+// CheckUnchanged re-reads and re-hashes the source and returns an error if
+// either the certificate or the key no longer matches the validated bytes.
+func (b *Bundle) CheckUnchanged() error {
+	if b.reload == nil {
+		return nil
+	}
+	certPem, keyPem, err := b.reload()
+	if err != nil {
+		return err
+	}
+	if sum := sha256.Sum256(certPem); !bytes.Equal(sum[:], b.certSum[:]) {
+		return fmt.Errorf("the certificate from %s changed after it was validated", b.Source)
+	}
+	if sum := sha256.Sum256(keyPem); !bytes.Equal(sum[:], b.keySum[:]) {
+		return fmt.Errorf("the private key from %s changed after it was validated", b.Source)
+	}
+	return nil
+}
+
+// CheckKeyFile refuses a private key that is readable or writable by group or
+// others, or that is not owned by the expected user. When owner is empty the
+// key must belong to the effective user or to root.
+func CheckKeyFile(path string, owner string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("could not stat the private key, %v", err)
+	}
+	return checkKeyInfo(path, info, owner)
+}
+
+// ReadKeyFile resolves path and reads it with the private key checks in opts,
+// for files such as traefik's acme.json that hold private keys.
+func ReadKeyFile(path string, what string, opts Options) ([]byte, error) {
+	resolved, err := resolve(path, what)
+	if err != nil {
+		return nil, err
+	}
+	return readKey(resolved, opts)
+}
+
+// readKey opens the resolved private key once, so that the permission checks
+// apply to the very file whose bytes are read.
+func readKey(path string, opts Options) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the pem encoded private key, %v", err)
+	}
+	defer f.Close()
+
+	if opts.CheckPermissions {
+		info, err := f.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("could not stat the private key, %v", err)
+		}
+		if err = checkKeyInfo(path, info, opts.KeyOwner); err != nil {
+			return nil, err
+		}
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the pem encoded private key, %v", err)
+	}
+	return data, nil
+}
+
+func checkKeyInfo(path string, info os.FileInfo, owner string) error {
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("private key %s is not a regular file", path)
+	}
+	if perm := info.Mode().Perm(); perm&0o066 != 0 {
+		return fmt.Errorf("private key %s has insecure permissions %04o, it must not be accessible by group or others", path, perm)
+	}
+	return checkOwner(path, info, owner)
+}
+
+// resolve follows any symlinks in path and reports where they lead, this
+// makes certbot's live/ to archive/ layout visible in the logs.
+func resolve(path string, what string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve the %s path, %v", what, err)
+	}
+	if resolved != filepath.Clean(path) {
+		log.Printf("%s %s resolves to %s", what, path, resolved)
+	}
+	return resolved, nil
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package certfile
+
+import (
+	"bytes"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// copy the test certificate and key into dir, the key with the given mode
+func copyTestFiles(t *testing.T, dir string, keyMode os.FileMode) (string, string) {
+	certPath := filepath.Join(dir, "fullchain.pem")
+	keyPath := filepath.Join(dir, "privkey.pem")
+	for src, dst := range map[string]string{"test_files/fullchain.pem": certPath, "test_files/privkey.pem": keyPath} {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatalf("reading %s failed with error: %v", src, err)
+		}
+		if err = os.WriteFile(dst, data, 0o600); err != nil {
+			t.Fatalf("writing %s failed with error: %v", dst, err)
+		}
+	}
+	if err := os.Chmod(keyPath, keyMode); err != nil {
+		t.Fatalf("chmod failed with error: %v", err)
+	}
+	return certPath, keyPath
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := copyTestFiles(t, dir, 0o600)
+
+	bundle, err := Load(certPath, keyPath, Options{CheckPermissions: true})
+	if err != nil {
+		t.Fatalf("Load failed with error: %v", err)
+	}
+	if err = bundle.Verify(); err != nil {
+		t.Errorf("Verify failed with error: %v", err)
+	}
+	if err = bundle.CheckUnchanged(); err != nil {
+		t.Errorf("CheckUnchanged failed with error: %v", err)
+	}
+
+	// a modified key must be detected before upload
+	if err = os.WriteFile(keyPath, append(bundle.PrivateKey, '\n'), 0o600); err != nil {
+		t.Fatalf("rewriting the key failed with error: %v", err)
+	}
+	if err = bundle.CheckUnchanged(); err == nil {
+		t.Errorf("CheckUnchanged should fail after the key was modified")
+	}
+}
+
+func TestInsecurePermissions(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := copyTestFiles(t, dir, 0o644)
+
+	if _, err := Load(certPath, keyPath, Options{CheckPermissions: true}); err == nil {
+		t.Errorf("Load should refuse a world readable private key")
+	}
+	if _, err := Load(certPath, keyPath, Options{CheckPermissions: false}); err != nil {
+		t.Errorf("Load with the checks disabled failed with error: %v", err)
+	}
+	if _, err := Load(certPath, keyPath, Options{CheckPermissions: true, KeyOwner: "no-such-user-tnascert"}); err == nil {
+		t.Errorf("Load should fail with an unknown key owner")
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	live := filepath.Join(dir, "live")
+	for _, d := range []string{archive, live} {
+		if err := os.Mkdir(d, 0o700); err != nil {
+			t.Fatalf("mkdir failed with error: %v", err)
+		}
+	}
+	certPath, keyPath := copyTestFiles(t, archive, 0o600)
+	certLink := filepath.Join(live, "fullchain.pem")
+	keyLink := filepath.Join(live, "privkey.pem")
+	if err := os.Symlink(certPath, certLink); err != nil {
+		t.Fatalf("symlink failed with error: %v", err)
+	}
+	if err := os.Symlink(keyPath, keyLink); err != nil {
+		t.Fatalf("symlink failed with error: %v", err)
+	}
+
+	bundle, err := Load(certLink, keyLink, Options{CheckPermissions: true})
+	if err != nil {
+		t.Fatalf("Load failed with error: %v", err)
+	}
+	if want, _ := filepath.EvalSymlinks(keyPath); bundle.KeyResolved != want {
+		t.Errorf("KeyResolved should be %s, got %s", want, bundle.KeyResolved)
+	}
+
+	// the permission checks apply to the symlink target
+	if err = os.Chmod(keyPath, 0o640); err != nil {
+		t.Fatalf("chmod failed with error: %v", err)
+	}
+	if _, err = Load(certLink, keyLink, Options{CheckPermissions: true}); err == nil {
+		t.Errorf("Load should refuse a group readable symlink target")
+	}
+}
+
+func TestEncode(t *testing.T) {
+	bundle, err := Load("test_files/fullchain.pem", "test_files/privkey.pem", Options{})
+	if err != nil {
+		t.Fatalf("Load failed with error: %v", err)
+	}
+
+	// the test certificate has no chain
+	leaf, err := bundle.Leaf()
+	if err != nil || !bytes.Equal(bytes.TrimSpace(leaf), bytes.TrimSpace(bundle.Certificate)) {
+		t.Errorf("Leaf returned %s, %v", leaf, err)
+	}
+	if chain, err := bundle.Chain(); err != nil || chain != nil {
+		t.Errorf("Chain returned %s, %v", chain, err)
+	}
+	if certPem, keyPem, err := SplitPEM(bundle.Combined()); err != nil || !bytes.Equal(certPem, leaf) || !bytes.Equal(keyPem, bundle.PrivateKey) {
+		t.Errorf("the combined pem does not split back, %v", err)
+	}
+	if cert, key, err := bundle.DER(); err != nil {
+		t.Errorf("DER failed with error: %v", err)
+	} else if _, err = x509.ParseCertificate(cert); err != nil {
+		t.Errorf("the der certificate does not parse, %v", err)
+	} else if _, err = x509.ParsePKCS8PrivateKey(key); err != nil {
+		t.Errorf("the der key does not parse, %v", err)
+	}
+
+	p12, err := bundle.PKCS12("secret")
+	if err != nil {
+		t.Fatalf("PKCS12 failed with error: %v", err)
+	}
+	if !bundle.SamePKCS12(p12, "secret") {
+		t.Errorf("the PKCS#12 file should hold the same key pair")
+	}
+	if bundle.SamePKCS12(p12, "wrong") {
+		t.Errorf("the PKCS#12 file should not open with the wrong password")
+	}
+
+	// the test certificate has no extended key usage extension
+	if usages, err := bundle.ExtKeyUsage(); err != nil || len(usages) != 0 {
+		t.Errorf("ExtKeyUsage returned %v, %v", usages, err)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/*
+ * Output formats of a certificate key pair written to files for services
+ * that read them from disk.
+ */
+
+package certfile
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// parse the key pair, the first certificate is the leaf
+func (b *Bundle) keyPair() (*tls.Certificate, error) {
+	pair, err := tls.X509KeyPair(b.Certificate, b.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("X509KeyPair error: %v", err)
+	}
+	return &pair, nil
+}
+
+// Leaf returns the pem encoded certificate without its chain
+func (b *Bundle) Leaf() ([]byte, error) {
+	pair, err := b.keyPair()
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pair.Certificate[0]}), nil
+}
+
+// Chain returns the pem encoded intermediate certificates, nil if there are none
+func (b *Bundle) Chain() ([]byte, error) {
+	pair, err := b.keyPair()
+	if err != nil {
+		return nil, err
+	}
+	var chain []byte
+	for _, der := range pair.Certificate[1:] {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return chain, nil
+}
+
+// Combined returns the certificate chain followed by the private key in one pem stream
+func (b *Bundle) Combined() []byte {
+	combined := append([]byte{}, b.Certificate...)
+	if len(combined) > 0 && combined[len(combined)-1] != '\n' {
+		combined = append(combined, '\n')
+	}
+	return append(combined, b.PrivateKey...)
+}
+
+// DER returns the der encoded certificate and PKCS#8 private key
+func (b *Bundle) DER() ([]byte, []byte, error) {
+	pair, err := b.keyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(pair.PrivateKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not encode the private key, %v", err)
+	}
+	return pair.Certificate[0], key, nil
+}
+
+// PKCS12 returns the key pair and chain encoded as a PKCS#12 file protected by password
+func (b *Bundle) PKCS12(password string) ([]byte, error) {
+	pair, err := b.keyPair()
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for _, der := range pair.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("ParseCertificate error: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	data, err := pkcs12.Modern.WithRand(rand.Reader).Encode(pair.PrivateKey, certs[0], certs[1:], password)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode the PKCS#12 file, %v", err)
+	}
+	return data, nil
+}
+
+// SamePKCS12 reports whether a PKCS#12 file holds the same key pair and chain,
+// the encoding is salted so the bytes differ each time it is written
+func (b *Bundle) SamePKCS12(data []byte, password string) bool {
+	key, cert, chain, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return false
+	}
+	pair, err := b.keyPair()
+	if err != nil || len(pair.Certificate) != len(chain)+1 || !bytes.Equal(cert.Raw, pair.Certificate[0]) {
+		return false
+	}
+	for i, c := range chain {
+		if !bytes.Equal(c.Raw, pair.Certificate[i+1]) {
+			return false
+		}
+	}
+	have, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return false
+	}
+	want, err := x509.MarshalPKCS8PrivateKey(pair.PrivateKey)
+	return err == nil && bytes.Equal(have, want)
+}
+
+// ExtKeyUsage returns the extended key usages of the leaf certificate
+func (b *Bundle) ExtKeyUsage() ([]x509.ExtKeyUsage, error) {
+	pair, err := b.keyPair()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("ParseCertificate error: %v", err)
+	}
+	return cert.ExtKeyUsage, nil
+}
@@ -0,0 +1,64 @@
+//go:build unix
+
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package certfile
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+func checkOwner(path string, info os.FileInfo, owner string) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("could not determine the owner of %s", path)
+	}
+	uid := uint64(st.Uid)
+
+	if owner == "" {
+		if uid == 0 || uid == uint64(os.Geteuid()) {
+			return nil
+		}
+		return fmt.Errorf("private key %s is owned by uid %d, expected root or uid %d", path, uid, os.Geteuid())
+	}
+
+	expected, err := lookupUid(owner)
+	if err != nil {
+		return err
+	}
+	if uid != expected {
+		return fmt.Errorf("private key %s is owned by uid %d, expected %s (uid %d)", path, uid, owner, expected)
+	}
+	return nil
+}
+
+// lookupUid accepts either a user name or a numeric uid
+func lookupUid(owner string) (uint64, error) {
+	if uid, err := strconv.ParseUint(owner, 10, 32); err == nil {
+		return uid, nil
+	}
+	u, err := user.Lookup(owner)
+	if err != nil {
+		return 0, fmt.Errorf("unknown key_owner %s, %v", owner, err)
+	}
+	return strconv.ParseUint(u.Uid, 10, 32)
+}
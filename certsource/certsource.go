@@ -0,0 +1,130 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package certsource
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"tnascert-deploy/certfile"
+	"tnascert-deploy/config"
+	"tnascert-deploy/vault"
+)
+
+// CertSource loads the certificate chain and private key to deploy
+type CertSource interface {
+	Load() (*certfile.Bundle, error)
+	String() string
+}
+
+// New returns the certificate source selected by the section's source setting:
+//
+//	file (or empty)                  full_chain_path and private_key_path
+//	exec:<command>                   pem printed on stdout by a shell command
+//	http://... or https://...        pem fetched from a distribution endpoint
+//	stdin                            pem read from standard input
+//	fd:<n>                           pem read from an inherited file descriptor
+//	traefik:/path/acme.json#resolver/domain
+//	caddy:/path/to/storage#domain
+//	vault                            the vault_cert_path or vault_pki_path, read with vc
+//
+// A stdin or fd source keeps what it reads in inputs, which may be nil when
+// the run loads a single section.
+func New(cfg *config.Config, vc *vault.Client, inputs Inputs) (CertSource, error) {
+	opts := certfile.Options{CheckPermissions: !cfg.SkipPermChecks, KeyOwner: cfg.KeyOwner}
+	source := cfg.Source
+
+	switch {
+	case source == "" || source == config.SourceFile:
+		return &File{CertPath: cfg.FullChainPath, KeyPath: cfg.Private_key_path, Options: opts}, nil
+	case source == config.SourceStdin:
+		return &Reader{Name: "stdin", File: os.Stdin, Inputs: inputs}, nil
+	case strings.HasPrefix(source, config.SourceFD+":"):
+		fd, err := strconv.ParseUint(strings.TrimPrefix(source, config.SourceFD+":"), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file descriptor in source %s", source)
+		}
+		return &Reader{Name: source, File: os.NewFile(uintptr(fd), source), Inputs: inputs}, nil
+	case strings.HasPrefix(source, config.SourceExec+":"):
+		return &Exec{Command: strings.TrimPrefix(source, config.SourceExec+":"), TimeoutSeconds: cfg.TimeoutSeconds}, nil
+	case strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"):
+		return NewHTTP(source, cfg)
+	case strings.HasPrefix(source, config.SourceTraefik+":"), strings.HasPrefix(source, config.SourceCaddy+":"):
+		return newProxy(source, opts)
+	case source == config.SourceVault:
+		return &Vault{Client: vc, cfg: cfg}, nil
+	}
+	return nil, fmt.Errorf("unsupported certificate source %s", source)
+}
+
+// File reads the certificate and key from files, today's behaviour
+type File struct {
+	CertPath string
+	KeyPath  string
+	Options  certfile.Options
+}
+
+func (f *File) Load() (*certfile.Bundle, error) {
+	return certfile.Load(f.CertPath, f.KeyPath, f.Options)
+}
+
+func (f *File) String() string {
+	return fmt.Sprintf("files %s and %s", f.CertPath, f.KeyPath)
+}
+
+// Reader reads the pem encoded certificate and key from stdin or an
+// inherited file descriptor, so that the key never touches the disk
+type Reader struct {
+	Name   string
+	File   *os.File
+	Inputs Inputs
+}
+
+// Inputs holds the input of each stdin or fd source during one run, read once
+// and kept in memory so that every section of a hook run deploys the same
+// certificate
+type Inputs map[string][]byte
+
+func (r *Reader) Load() (*certfile.Bundle, error) {
+	data, ok := r.Inputs[r.Name]
+	if !ok {
+		if r.File == nil {
+			return nil, fmt.Errorf("%s is not open", r.Name)
+		}
+		var err error
+		data, err = io.ReadAll(r.File)
+		r.File.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not read from %s, %v", r.Name, err)
+		}
+		if r.Inputs != nil {
+			r.Inputs[r.Name] = data
+		}
+	}
+	certPem, keyPem, err := certfile.SplitPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s, %v", r.Name, err)
+	}
+	return certfile.NewBundle(r.Name, certPem, keyPem), nil
+}
+
+func (r *Reader) String() string {
+	return r.Name
+}
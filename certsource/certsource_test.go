@@ -0,0 +1,288 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package certsource
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"tnascert-deploy/certfile"
+	"tnascert-deploy/config"
+)
+
+func testPair(t *testing.T) ([]byte, []byte) {
+	certPem, err := os.ReadFile("test_files/fullchain.pem")
+	if err != nil {
+		t.Fatalf("reading the certificate failed with error: %v", err)
+	}
+	keyPem, err := os.ReadFile("test_files/privkey.pem")
+	if err != nil {
+		t.Fatalf("reading the private key failed with error: %v", err)
+	}
+	return certPem, keyPem
+}
+
+func testPem(t *testing.T) []byte {
+	certPem, keyPem := testPair(t)
+	return append(certPem, keyPem...)
+}
+
+// parse a traefik or caddy source and load it
+func loadProxy(source string, opts certfile.Options) (*certfile.Bundle, error) {
+	src, err := newProxy(source, opts)
+	if err != nil {
+		return nil, err
+	}
+	return src.Load()
+}
+
+func TestFileSource(t *testing.T) {
+	cfg := &config.Config{
+		FullChainPath:    "test_files/fullchain.pem",
+		Private_key_path: "test_files/privkey.pem",
+		SkipPermChecks:   true,
+	}
+	source, err := New(cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("New failed with error: %v", err)
+	}
+	if _, ok := source.(*File); !ok {
+		t.Fatalf("an empty source should select the file source, got %T", source)
+	}
+	bundle, err := source.Load()
+	if err != nil {
+		t.Fatalf("Load failed with error: %v", err)
+	}
+	if err = bundle.Verify(); err != nil {
+		t.Errorf("Verify failed with error: %v", err)
+	}
+}
+
+func TestExecSource(t *testing.T) {
+	cfg := &config.Config{Source: "exec:cat test_files/fullchain.pem test_files/privkey.pem", TimeoutSeconds: 10}
+	source, err := New(cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("New failed with error: %v", err)
+	}
+	bundle, err := source.Load()
+	if err != nil {
+		t.Fatalf("Load failed with error: %v", err)
+	}
+	if err = bundle.Verify(); err != nil {
+		t.Errorf("Verify failed with error: %v", err)
+	}
+	if source.String() != "exec:cat" {
+		t.Errorf("String should not include the command arguments, got %s", source)
+	}
+	for command, name := range map[string]string{
+		"VAULT_TOKEN=secret OTHER_1=x vault read": "exec:vault",
+		"  TOKEN=secret":              "exec",
+		"./print-cert --token=secret": "exec:./print-cert",
+		"=x cat":                      "exec:=x",
+	} {
+		if s := (&Exec{Command: command}).String(); s != name {
+			t.Errorf("String of %q should be %s, got %s", command, name, s)
+		}
+	}
+
+	cfg.Source = "exec:cat test_files/fullchain.pem"
+	source, _ = New(cfg, nil, nil)
+	if _, err = source.Load(); err == nil {
+		t.Errorf("Load should fail when the command prints no private key")
+	}
+	cfg.Source = "exec:exit 3"
+	source, _ = New(cfg, nil, nil)
+	if _, err = source.Load(); err == nil {
+		t.Errorf("Load should fail when the command fails")
+	}
+}
+
+// the sections of a hook run each load the same stdin or fd input
+func TestReaderSource(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe failed with error: %v", err)
+	}
+	data := testPem(t)
+	go func() {
+		w.Write(data)
+		w.Close()
+	}()
+	cfg := &config.Config{Source: fmt.Sprintf("fd:%d", r.Fd())}
+	inputs := Inputs{}
+	for i := 0; i < 2; i++ {
+		source, err := New(cfg, nil, inputs)
+		if err != nil {
+			t.Fatalf("New failed with error: %v", err)
+		}
+		bundle, err := source.Load()
+		if err != nil {
+			t.Fatalf("Load %d failed with error: %v", i+1, err)
+		}
+		if err = bundle.Verify(); err != nil {
+			t.Errorf("Verify failed with error: %v", err)
+		}
+	}
+	if len(inputs) != 1 {
+		t.Errorf("expected the input of one source, got %d", len(inputs))
+	}
+}
+
+func TestHTTPSource(t *testing.T) {
+	data := testPem(t)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	// write the test server certificate as the CA bundle
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+		t.Fatalf("writing the CA bundle failed with error: %v", err)
+	}
+
+	cfg := &config.Config{Source: server.URL + "/certs/nas01?key=1", SourceToken: "secret", SourceCAFile: caFile, TimeoutSeconds: 10}
+	source, err := New(cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("New failed with error: %v", err)
+	}
+	bundle, err := source.Load()
+	if err != nil {
+		t.Fatalf("Load failed with error: %v", err)
+	}
+	if err = bundle.Verify(); err != nil {
+		t.Errorf("Verify failed with error: %v", err)
+	}
+	if strings.Contains(source.String(), "key=1") {
+		t.Errorf("String should not include the query string, got %s", source)
+	}
+
+	cfg.SourceToken = "wrong"
+	source, _ = New(cfg, nil, nil)
+	if _, err = source.Load(); err == nil {
+		t.Errorf("Load should fail with the wrong bearer token")
+	}
+
+	// without the CA bundle the test server certificate is not trusted
+	cfg.SourceToken, cfg.SourceCAFile = "secret", ""
+	source, _ = New(cfg, nil, nil)
+	if _, err = source.Load(); err == nil {
+		t.Errorf("Load should fail without the CA bundle")
+	}
+}
+
+func TestFDSource(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe failed with error: %v", err)
+	}
+	data := testPem(t)
+	go func() {
+		w.Write(data)
+		w.Close()
+	}()
+
+	source, err := New(&config.Config{Source: fmt.Sprintf("fd:%d", r.Fd())}, nil, nil)
+	if err != nil {
+		t.Fatalf("New failed with error: %v", err)
+	}
+	bundle, err := source.Load()
+	if err != nil {
+		t.Fatalf("Load failed with error: %v", err)
+	}
+	if err = bundle.Verify(); err != nil {
+		t.Errorf("Verify failed with error: %v", err)
+	}
+
+	if _, err = New(&config.Config{Source: "fd:three"}, nil, nil); err == nil {
+		t.Errorf("New should fail with an invalid file descriptor")
+	}
+}
+
+func TestTraefikSource(t *testing.T) {
+	certPem, keyPem := testPair(t)
+	store := map[string]interface{}{
+		"letsencrypt": map[string]interface{}{
+			"Certificates": []map[string]interface{}{{
+				"domain":      map[string]interface{}{"main": "nas01.mydomain.com", "sans": []string{"nas.mydomain.com"}},
+				"certificate": base64.StdEncoding.EncodeToString(certPem),
+				"key":         base64.StdEncoding.EncodeToString(keyPem),
+				"Store":       "default",
+			}},
+		},
+	}
+	data, _ := json.Marshal(store)
+	path := filepath.Join(t.TempDir(), "acme.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("writing acme.json failed with error: %v", err)
+	}
+
+	bundle, err := loadProxy("traefik:"+path+"#letsencrypt/nas.mydomain.com", certfile.Options{CheckPermissions: true})
+	if err != nil {
+		t.Fatalf("loading the source failed with error: %v", err)
+	}
+	if err = bundle.Verify(); err != nil {
+		t.Errorf("Verify failed with error: %v", err)
+	}
+	if err = bundle.CheckUnchanged(); err != nil {
+		t.Errorf("CheckUnchanged failed with error: %v", err)
+	}
+	if _, err = loadProxy("traefik:"+path+"#other/nas.mydomain.com", certfile.Options{}); err == nil {
+		t.Errorf("loading should fail for an unknown resolver")
+	}
+	if _, err = loadProxy("traefik:"+path+"#letsencrypt/nas02.mydomain.com", certfile.Options{}); err == nil {
+		t.Errorf("loading should fail for an unknown domain")
+	}
+}
+
+func TestCaddySource(t *testing.T) {
+	storage := t.TempDir()
+	dir := filepath.Join(storage, "certificates", "acme-v02.api.letsencrypt.org-directory", "nas01.mydomain.com")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatalf("mkdir failed with error: %v", err)
+	}
+	certPem, keyPem := testPair(t)
+	os.WriteFile(filepath.Join(dir, "nas01.mydomain.com.crt"), certPem, 0o600)
+	os.WriteFile(filepath.Join(dir, "nas01.mydomain.com.key"), keyPem, 0o600)
+
+	bundle, err := loadProxy("caddy:"+storage+"#nas01.mydomain.com", certfile.Options{CheckPermissions: true})
+	if err != nil {
+		t.Fatalf("loading the source failed with error: %v", err)
+	}
+	if err = bundle.Verify(); err != nil {
+		t.Errorf("Verify failed with error: %v", err)
+	}
+	if _, err = loadProxy("caddy:"+storage+"#nas02.mydomain.com", certfile.Options{}); err == nil {
+		t.Errorf("loading should fail for an unknown domain")
+	}
+	if _, err = loadProxy("caddy:"+storage, certfile.Options{}); err == nil {
+		t.Errorf("loading should fail without a domain")
+	}
+}
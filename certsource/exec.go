@@ -0,0 +1,79 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package certsource
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+	"tnascert-deploy/certfile"
+)
+
+// Exec runs a shell command that prints the pem encoded certificate chain and
+// private key on stdout, such as a password manager or vault CLI
+type Exec struct {
+	Command        string
+	TimeoutSeconds int64
+}
+
+func (e *Exec) Load() (*certfile.Bundle, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(e.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", e.Command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("certificate command failed, %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	certPem, keyPem, err := certfile.SplitPEM(stdout.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("certificate command output, %v", err)
+	}
+	return certfile.NewBundle(e.String(), certPem, keyPem), nil
+}
+
+// String names the program only, the arguments and the NAME=value
+// assignments before it may hold secrets
+func (e *Exec) String() string {
+	for _, field := range strings.Fields(e.Command) {
+		if !isAssignment(field) {
+			return "exec:" + field
+		}
+	}
+	return "exec"
+}
+
+// a shell variable assignment such as TOKEN=secret
+func isAssignment(word string) bool {
+	name, _, ok := strings.Cut(word, "=")
+	if !ok || name == "" {
+		return false
+	}
+	for i, c := range name {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
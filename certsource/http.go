@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package certsource
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"tnascert-deploy/certfile"
+	"tnascert-deploy/config"
+)
+
+// limit on the size of a response from the distribution endpoint
+const maxResponseBytes = 1 << 20
+
+// HTTP fetches the pem encoded certificate chain and private key from a
+// certificate distribution endpoint
+type HTTP struct {
+	URL    string
+	Token  string // optional bearer token
+	client *http.Client
+}
+
+// NewHTTP configures the bearer token and CA bundle from the section
+func NewHTTP(source string, cfg *config.Config) (*HTTP, error) {
+	h := &HTTP{URL: source, Token: cfg.SourceToken}
+	if cfg.SourceTokenFile != "" {
+		token, err := os.ReadFile(cfg.SourceTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read source_token_file, %v", err)
+		}
+		h.Token = strings.TrimSpace(string(token))
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.SourceCAFile != "" {
+		ca, err := os.ReadFile(cfg.SourceCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read source_ca_file, %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in source_ca_file %s", cfg.SourceCAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	h.client = &http.Client{Transport: transport, Timeout: time.Duration(cfg.TimeoutSeconds) * time.Second}
+	return h, nil
+}
+
+func (h *HTTP) Load() (*certfile.Bundle, error) {
+	req, err := http.NewRequest(http.MethodGet, h.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/x-pem-file")
+	if h.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.Token)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching the certificate failed, %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching the certificate failed, %s returned %s", h, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+	if err != nil {
+		return nil, fmt.Errorf("fetching the certificate failed, %v", err)
+	}
+
+	certPem, keyPem, err := certfile.SplitPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s, %v", h, err)
+	}
+	return certfile.NewBundle(h.String(), certPem, keyPem), nil
+}
+
+// String omits any credentials and query string from the URL
+func (h *HTTP) String() string {
+	u, err := url.Parse(h.URL)
+	if err != nil {
+		return "http"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package certsource
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"tnascert-deploy/certfile"
+	"tnascert-deploy/config"
+)
+
+// newProxy parses a traefik:/path/acme.json#resolver/domain or a
+// caddy:/path/to/storage#domain source
+func newProxy(source string, opts certfile.Options) (CertSource, error) {
+	kind, spec, _ := strings.Cut(source, ":")
+	path, fragment, ok := strings.Cut(spec, "#")
+	if !ok || path == "" || fragment == "" {
+		return nil, fmt.Errorf("invalid %s source %s, expected a path and a #fragment", kind, source)
+	}
+	if kind == config.SourceCaddy {
+		return &Caddy{Storage: path, Domain: fragment, Options: opts}, nil
+	}
+	resolver, domain, ok := strings.Cut(fragment, "/")
+	if !ok || resolver == "" || domain == "" {
+		return nil, fmt.Errorf("invalid traefik source %s, expected #resolver/domain", source)
+	}
+	return &Traefik{Path: path, Resolver: resolver, Domain: domain, Options: opts}, nil
+}
+
+// Traefik reads the certificate and key for Domain issued by Resolver from a
+// traefik acme.json file. The domain may be the main domain or a SAN.
+type Traefik struct {
+	Path     string
+	Resolver string
+	Domain   string
+	Options  certfile.Options
+}
+
+// traefik acme.json, keyed by certificate resolver name
+type traefikStore map[string]struct {
+	Certificates []struct {
+		Domain struct {
+			Main string   `json:"main"`
+			SANs []string `json:"sans"`
+		} `json:"domain"`
+		Certificate string `json:"certificate"` // base64 encoded pem
+		Key         string `json:"key"`         // base64 encoded pem
+	} `json:"Certificates"`
+}
+
+func (t *Traefik) Load() (*certfile.Bundle, error) {
+	// acme.json holds every private key, so the key checks apply to the whole file
+	data, err := certfile.ReadKeyFile(t.Path, "traefik acme.json", t.Options)
+	if err != nil {
+		return nil, err
+	}
+	certPem, keyPem, err := t.pair(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s, %v", t.Path, err)
+	}
+
+	return certfile.NewBundleFunc(t.String(), certPem, keyPem, func() ([]byte, []byte, error) {
+		data, err := os.ReadFile(t.Path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not re-read %s, %v", t.Path, err)
+		}
+		return t.pair(data)
+	}), nil
+}
+
+func (t *Traefik) pair(data []byte) ([]byte, []byte, error) {
+	var store traefikStore
+	if err := json.Unmarshal(data, &store); err != nil {
+		return nil, nil, fmt.Errorf("could not parse the traefik acme.json, %v", err)
+	}
+	r, ok := store[t.Resolver]
+	if !ok {
+		return nil, nil, fmt.Errorf("certificate resolver %s not found", t.Resolver)
+	}
+	for _, cert := range r.Certificates {
+		names := append([]string{cert.Domain.Main}, cert.Domain.SANs...)
+		for _, name := range names {
+			if !strings.EqualFold(name, t.Domain) {
+				continue
+			}
+			certPem, err := base64.StdEncoding.DecodeString(cert.Certificate)
+			if err != nil {
+				return nil, nil, fmt.Errorf("could not decode the certificate for %s, %v", t.Domain, err)
+			}
+			keyPem, err := base64.StdEncoding.DecodeString(cert.Key)
+			if err != nil {
+				return nil, nil, fmt.Errorf("could not decode the private key for %s, %v", t.Domain, err)
+			}
+			return certPem, keyPem, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("no certificate for %s in resolver %s", t.Domain, t.Resolver)
+}
+
+func (t *Traefik) String() string {
+	return fmt.Sprintf("%s:%s#%s/%s", config.SourceTraefik, t.Path, t.Resolver, t.Domain)
+}
+
+// Caddy reads the certificate and key for Domain from a caddy storage
+// directory, certificates/<issuer>/<domain>/<domain>.{crt,key}. When more
+// than one issuer holds a certificate for the domain the one that expires
+// last is used.
+type Caddy struct {
+	Storage string
+	Domain  string
+	Options certfile.Options
+}
+
+func (c *Caddy) Load() (*certfile.Bundle, error) {
+	// caddy stores wildcard certificates as wildcard_.example.com
+	name := strings.ToLower(c.Domain)
+	if strings.HasPrefix(name, "*.") {
+		name = "wildcard_" + name[1:]
+	}
+
+	matches, err := filepath.Glob(filepath.Join(c.Storage, "certificates", "*", name, name+".crt"))
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no certificate for %s in caddy storage %s", c.Domain, c.Storage)
+	}
+
+	var certPath string
+	var notAfter int64
+	for _, m := range matches {
+		data, err := os.ReadFile(m)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the pem encoded certificate, %v", err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			continue
+		}
+		leaf, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if certPath == "" || leaf.NotAfter.Unix() > notAfter {
+			certPath, notAfter = m, leaf.NotAfter.Unix()
+		}
+	}
+	if certPath == "" {
+		return nil, fmt.Errorf("no valid certificate for %s in caddy storage %s", c.Domain, c.Storage)
+	}
+
+	b, err := certfile.Load(certPath, strings.TrimSuffix(certPath, ".crt")+".key", c.Options)
+	if err != nil {
+		return nil, err
+	}
+	b.Source = c.String()
+	return b, nil
+}
+
+func (c *Caddy) String() string {
+	return fmt.Sprintf("%s:%s#%s", config.SourceCaddy, c.Storage, c.Domain)
+}
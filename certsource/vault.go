@@ -0,0 +1,63 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package certsource
+
+import (
+	"fmt"
+	"strings"
+	"tnascert-deploy/certfile"
+	"tnascert-deploy/config"
+	"tnascert-deploy/vault"
+)
+
+// Vault reads the certificate from a KV v2 secret or issues one from a PKI
+// issue endpoint
+type Vault struct {
+	Client *vault.Client
+	cfg    *config.Config
+}
+
+func (v *Vault) Load() (*certfile.Bundle, error) {
+	if v.Client == nil {
+		return nil, fmt.Errorf("not logged in to vault")
+	}
+
+	var cert *vault.Certificate
+	var err error
+	if v.cfg.VaultPKIPath != "" {
+		cert, err = v.Client.IssueCertificate(v.cfg.VaultPKIPath, v.cfg.VaultCommonName, v.cfg.Domains, v.cfg.VaultPKITTL)
+	} else {
+		cert, err = v.Client.ReadCertificate(v.cfg.VaultKVMount, v.cfg.VaultCertPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	certPem := strings.TrimSpace(cert.Certificate) + "\n"
+	if cert.Chain != "" {
+		certPem += strings.TrimSpace(cert.Chain) + "\n"
+	}
+	return certfile.NewBundle(v.String(), []byte(certPem), []byte(strings.TrimSpace(cert.PrivateKey)+"\n")), nil
+}
+
+func (v *Vault) String() string {
+	if v.cfg.VaultPKIPath != "" {
+		return "vault:" + v.cfg.VaultPKIPath
+	}
+	return "vault:" + v.cfg.VaultKVMount + "/" + v.cfg.VaultCertPath
+}
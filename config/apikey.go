@@ -0,0 +1,183 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"encoding/base32"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ApiKeySource describes where the api key or password was read from, it
+// never includes the secret
+func (c *Config) ApiKeySource() string {
+	return c.apiKeySource
+}
+
+// resolveApiKey reads the api key from the one configured source: inline
+// api_key, api_key_file, api_key_env, a systemd credential or vault, or the
+// password for a username login. The secret itself is never logged.
+func (c *Config) resolveApiKey() error {
+	var sources []string
+	if c.Api_key != "" {
+		sources = append(sources, "api_key")
+	}
+	if c.ApiKeyFile != "" {
+		sources = append(sources, "api_key_file")
+	}
+	if c.ApiKeyEnv != "" {
+		sources = append(sources, "api_key_env")
+	}
+	if c.ApiKeyCredential != "" {
+		sources = append(sources, "api_key_credential")
+	}
+	if c.VaultApiKeyPath != "" {
+		sources = append(sources, "vault_api_key_path")
+	}
+	if c.Username != "" {
+		sources = append(sources, "username")
+	}
+	if len(sources) > 1 {
+		return fmt.Errorf("only one api key source may be defined, found %s", strings.Join(sources, ", "))
+	}
+	if c.Username == "" && (c.PasswordFile != "" || c.OtpSecretFile != "") {
+		return fmt.Errorf("password_file and otp_secret_file require a username")
+	}
+
+	origin := c.origins["api_key"]
+	switch {
+	case c.Api_key != "" && (strings.HasPrefix(origin, "$") || origin == "--set"):
+		// an override never touched the config file
+		c.apiKeySource = fmt.Sprintf("api_key override %s", origin)
+	case c.Api_key != "" && c.encrypted["api_key"]:
+		c.apiKeySource = fmt.Sprintf("encrypted api_key in %s", c.configFile)
+	case c.Api_key != "":
+		// a plain text inline key must not be readable by anyone else, it
+		// may have come from an included file
+		for _, file := range c.configFiles {
+			if err := c.checkSecretFile(file, "the config file holding an inline api_key"); err != nil {
+				return err
+			}
+		}
+		c.apiKeySource = fmt.Sprintf("api_key in %s", c.configFile)
+	case c.ApiKeyFile != "":
+		if err := c.checkSecretFile(c.ApiKeyFile, "api_key_file"); err != nil {
+			return err
+		}
+		key, err := readSecret(c.ApiKeyFile)
+		if err != nil {
+			return fmt.Errorf("could not read api_key_file, %v", err)
+		}
+		c.Api_key = key
+		c.apiKeySource = fmt.Sprintf("api_key_file %s", c.ApiKeyFile)
+	case c.ApiKeyEnv != "":
+		c.Api_key = strings.TrimSpace(os.Getenv(c.ApiKeyEnv))
+		if c.Api_key == "" {
+			return fmt.Errorf("api_key_env %s is not set", c.ApiKeyEnv)
+		}
+		c.apiKeySource = fmt.Sprintf("environment variable %s", c.ApiKeyEnv)
+	case c.ApiKeyCredential != "":
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return fmt.Errorf("api_key_credential is defined but CREDENTIALS_DIRECTORY is not set, use LoadCredential= in the systemd unit")
+		}
+		if strings.ContainsRune(c.ApiKeyCredential, filepath.Separator) {
+			return fmt.Errorf("invalid api_key_credential %s", c.ApiKeyCredential)
+		}
+		path := filepath.Join(dir, c.ApiKeyCredential)
+		key, err := readSecret(path)
+		if err != nil {
+			return fmt.Errorf("could not read the api_key_credential, %v", err)
+		}
+		c.Api_key = key
+		c.apiKeySource = fmt.Sprintf("systemd credential %s", c.ApiKeyCredential)
+	case c.VaultApiKeyPath != "":
+		// read after the vault login, see vault_api_key_path
+		c.apiKeySource = fmt.Sprintf("vault %s/%s", c.VaultKVMount, c.VaultApiKeyPath)
+	case c.Username != "":
+		return c.resolvePassword()
+	}
+	return nil
+}
+
+// resolvePassword reads the password and optional TOTP secret of a username
+// login, both files are held to the same permission checks as api_key_file
+func (c *Config) resolvePassword() error {
+	if c.PasswordFile == "" {
+		return fmt.Errorf("username %s requires a password_file", c.Username)
+	}
+	if err := c.checkSecretFile(c.PasswordFile, "password_file"); err != nil {
+		return err
+	}
+	password, err := readSecret(c.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("could not read password_file, %v", err)
+	}
+	c.Password = password
+	c.apiKeySource = fmt.Sprintf("%s with password_file %s", c.Username, c.PasswordFile)
+
+	if c.OtpSecretFile != "" {
+		if err = c.checkSecretFile(c.OtpSecretFile, "otp_secret_file"); err != nil {
+			return err
+		}
+		secret, err := readSecret(c.OtpSecretFile)
+		if err != nil {
+			return fmt.Errorf("could not read otp_secret_file, %v", err)
+		}
+		// authenticator apps show the secret in groups of four
+		secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+		if _, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "=")); err != nil {
+			return fmt.Errorf("otp_secret_file %s does not hold a base32 secret", c.OtpSecretFile)
+		}
+		c.OtpSecret = secret
+		c.apiKeySource += " and otp_secret_file"
+	}
+	if c.TokenTTL <= 0 {
+		c.TokenTTL = Default_token_ttl
+	}
+	return nil
+}
+
+// checkSecretFile refuses a file holding a secret that group or others can read
+func (c *Config) checkSecretFile(path string, what string) error {
+	if c.SkipPermChecks || path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("could not stat %s, %v", what, err)
+	}
+	if perm := info.Mode().Perm(); perm&0o044 != 0 {
+		return fmt.Errorf("%s %s is readable by others (mode %04o), restrict it to the owner or move the key to api_key_file, api_key_env or api_key_credential", what, path, perm)
+	}
+	return nil
+}
+
+func readSecret(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return secret, nil
+}
@@ -18,9 +18,17 @@
 package config
 
 import (
+	"errors"
+	"filippo.io/age"
 	"fmt"
 	"github.com/ncruces/go-strftime"
 	"gopkg.in/ini.v1"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -30,61 +38,294 @@ const (
 	Config_file             = "tnas-cert.ini"
 	Default_base_cert_name  = "tnas-cert-deploy"
 	Default_section         = "default"
+	Defaults_section        = "defaults" // settings shared by every section
 	Default_port            = 443
 	Default_protocol        = WSS
 	Default_timeout_seconds = 10
+	Default_token_ttl       = 600
+	Default_cert_field      = "network.certificate_id"
 	endpoint                = "api/current"
 )
 
+// certificate source types, see the source setting
+const (
+	SourceFile    = "file"
+	SourceExec    = "exec"
+	SourceHTTP    = "http"
+	SourceHTTPS   = "https"
+	SourceStdin   = "stdin"
+	SourceFD      = "fd"
+	SourceTraefik = "traefik"
+	SourceCaddy   = "caddy"
+	SourceVault   = "vault"
+)
+
+// Vault auth methods, see the vault_auth setting
+const (
+	VaultAuthToken     = "token"
+	VaultAuthTokenFile = "token_file"
+	VaultAuthAppRole   = "approle"
+)
+
+// how the apps given the certificate are chosen, see the app_selection setting
+const (
+	AppSelectionPatterns = "patterns" // the apps matching apps or app_name
+	AppSelectionFollow   = "follow"   // the apps already using a certificate of cert_basename
+)
+
+// what is done with an app that is stopped, see the stopped_apps setting
+const (
+	StoppedAppsSkip   = "skip"   // leave the app as it is
+	StoppedAppsUpdate = "update" // update the app and leave it stopped
+	StoppedAppsStart  = "start"  // update and start the app, then wait for it to run
+
+	Default_app_health_timeout = 300
+	Default_app_connections    = 4
+)
+
+// the services a certificate can be bound to, see the bind setting
+const (
+	BindUI     = "ui"     // the web UI, system.general ui_certificate
+	BindFTP    = "ftp"    // the FTP service, ftp ssltls_certificate
+	BindApps   = "apps"   // the apps selected by apps, app_name and app_selection
+	BindWebDAV = "webdav" // the WebDAV service, webdav certssl
+	BindLDAP   = "ldap"   // the LDAP client certificate, ldap certificate
+	BindS3     = "s3"     // the S3 service, s3 certificate
+	BindKMIP   = "kmip"   // the KMIP server, kmip certificate and certificate_authority
+	BindSyslog = "syslog" // the remote syslog TLS client certificate, system.advanced syslog_tls_certificate
+)
+
+// BindNames lists the values bind takes
+var BindNames = []string{BindUI, BindFTP, BindApps, BindWebDAV, BindLDAP, BindS3, BindKMIP, BindSyslog}
+
 type Config struct {
-	Api_key             string `ini:"api_key"`                // TrueNAS 64 byte API Key
-	CertBasename        string `ini:"cert_basename"`          // basename for cert naming in TrueNAS
-	ConnectHost         string `ini:"connect_host"`           // TrueNAS hostname
-	DeleteOldCerts      bool   `ini:"delete_old_certs"`       // whether to remove old certificates
-	FullChainPath       string `ini:"full_chain_path"`        // path to full_chain.pem
-	Port                uint64 `ini:"port"`                   // TrueNAS API endpoint port
-	Protocol            string `ini:"protocol"`               // websocket protocol 'ws' or 'wss' 'wss' is default
-	Private_key_path    string `ini:"private_key_path"`       // path to private_key.pem
-	TlsSkipVerify       bool   `ini:"tls_skip_verify"`        // strict SSL cert verification of the endpoint
-	AddAsUiCertificate  bool   `ini:"add_as_ui_certificate"`  // Install as the active UI certificate if true
-	AddAsFTPCertificate bool   `ini:"add_as_ftp_certificate"` // Install as the active FTP service certificate if true
-	AddAsAppCertificate bool   `ini:"add_as_app_certificate"` // Install as the active APP service certificate if true
-	AppName             string `ini:"app_name"`               // The name of the app to which the certificate will be added
-	TimeoutSeconds      int64  `ini:"timeoutSeconds"`         // the number of seconds after which the truenas client calls fail
-	Debug               bool   `ini:"debug"`                  // debug logging if true
-	certName            string // instance generated certificate name
-	serverURL           string // instance generated server URL
+	Api_key             string   `ini:"api_key"`                // TrueNAS 64 byte API Key
+	CertBasename        string   `ini:"cert_basename"`          // basename for cert naming in TrueNAS
+	ConnectHost         string   `ini:"connect_host"`           // TrueNAS hostname
+	DeleteOldCerts      bool     `ini:"delete_old_certs"`       // whether to remove old certificates
+	FullChainPath       string   `ini:"full_chain_path"`        // path to full_chain.pem
+	Port                uint64   `ini:"port"`                   // TrueNAS API endpoint port
+	Protocol            string   `ini:"protocol"`               // websocket protocol 'ws' or 'wss' 'wss' is default
+	Private_key_path    string   `ini:"private_key_path"`       // path to private_key.pem
+	TlsSkipVerify       bool     `ini:"tls_skip_verify"`        // skip the TLS certificate verification of the endpoint if true
+	AddAsUiCertificate  bool     `ini:"add_as_ui_certificate"`  // Install as the active UI certificate if true
+	AddAsFTPCertificate bool     `ini:"add_as_ftp_certificate"` // Install as the active FTP service certificate if true
+	AddAsAppCertificate bool     `ini:"add_as_app_certificate"` // Install as the active APP service certificate if true
+	Bind                []string `ini:"bind"`                   // services the certificate is bound to, see BindNames
+	AppName             string   `ini:"app_name"`               // The name of the app to which the certificate will be added
+	Apps                []string `ini:"apps"`                   // glob patterns of the apps to which the certificate will be added
+	ExcludeApps         []string `ini:"exclude_apps"`           // glob patterns of the apps left out of apps
+	AppSelection        string   `ini:"app_selection"`          // 'patterns' or 'follow', 'patterns' is default
+	CertFields          []string `ini:"cert_field"`             // path of the certificate id in the app values, optionally per app as app:path
+	AppHealthTimeout    int64    `ini:"app_health_timeout"`     // seconds to wait for an updated app to be RUNNING, 300 is default
+	StoppedApps         string   `ini:"stopped_apps"`           // 'skip', 'update' or 'start', 'update' is default
+	AppParallel         int64    `ini:"app_parallel"`           // the number of apps updated at the same time, 1 is default
+	AppConnections      int64    `ini:"app_connections"`        // the number of connections the app configs are read over, 4 is default
+	FileTargets         []string `ini:"file_targets"`           // names of the [file_target:name] sections the certificate is written to
+	CaPath              string   `ini:"ca_path"`                // pem CA certificate imported and bound by the bindings that take a certificate authority
+	TimeoutSeconds      int64    `ini:"timeoutSeconds"`         // the number of seconds after which the truenas client calls fail
+	Debug               bool     `ini:"debug"`                  // debug logging if true
+	SkipPermChecks      bool     `ini:"skip_permission_checks"` // skip the private key permission and owner checks if true
+	KeyOwner            string   `ini:"key_owner"`              // expected owner of the private key, defaults to root or the effective user
+	Domains             []string `ini:"domains"`                // domain names covered by the certificate, used to match renewal hooks
+	Source              string   `ini:"source"`                 // certificate source, file, exec:, http(s)://, stdin, fd:, traefik: or caddy:
+	SourceToken         string   `ini:"source_token"`           // bearer token for an http(s) certificate source
+	SourceTokenFile     string   `ini:"source_token_file"`      // file holding the bearer token for an http(s) certificate source
+	SourceCAFile        string   `ini:"source_ca_file"`         // CA bundle used to verify an https certificate source
+	ApiKeyFile          string   `ini:"api_key_file"`           // file holding the TrueNAS API key
+	ApiKeyEnv           string   `ini:"api_key_env"`            // environment variable holding the TrueNAS API key
+	ApiKeyCredential    string   `ini:"api_key_credential"`     // systemd credential name holding the TrueNAS API key
+	Username            string   `ini:"username"`               // TrueNAS user for a password login instead of an api key
+	PasswordFile        string   `ini:"password_file"`          // file holding the password of username
+	OtpSecretFile       string   `ini:"otp_secret_file"`        // file holding the base32 TOTP secret of username
+	GenerateToken       bool     `ini:"generate_token"`         // after a password login, re-authenticate with a short-lived token if true
+	TokenTTL            int64    `ini:"token_ttl"`              // lifetime in seconds of a generated token, 600 is default
+	Extends             string   `ini:"extends"`                // section whose settings this section inherits
+	Password            string   `ini:"-"`                      // read from password_file
+	OtpSecret           string   `ini:"-"`                      // read from otp_secret_file
+	VaultConfig         `ini:",extends"`
+	Targets             []*FileTarget     // the file_targets sections
+	configFile          string            // the config file the section was loaded from
+	configFiles         []string          // the config file and the files it includes
+	origins             map[string]string // the section each setting was inherited from
+	encrypted           map[string]bool   // keys whose values were ENC[age:...] encrypted
+	apiKeySource        string            // where the api key was read from
+	certName            string            // instance generated certificate name
+	serverURL           string            // instance generated server URL
+}
+
+// VaultConfig holds the HashiCorp Vault settings of a section, used by the
+// vault certificate source and to read the api_key
+type VaultConfig struct {
+	VaultAddr         string `ini:"vault_addr"`           // Vault server address, defaults to $VAULT_ADDR
+	VaultNamespace    string `ini:"vault_namespace"`      // Vault enterprise namespace
+	VaultCAFile       string `ini:"vault_ca_file"`        // CA bundle used to verify the Vault server
+	VaultAuth         string `ini:"vault_auth"`           // auth method, 'token', 'token_file' or 'approle', 'token' is default
+	VaultToken        string `ini:"vault_token"`          // token for the token auth method, defaults to $VAULT_TOKEN
+	VaultTokenFile    string `ini:"vault_token_file"`     // token file for the token_file auth method, defaults to ~/.vault-token
+	VaultRoleID       string `ini:"vault_role_id"`        // AppRole role_id
+	VaultSecretID     string `ini:"vault_secret_id"`      // AppRole secret_id
+	VaultSecretIDFile string `ini:"vault_secret_id_file"` // file holding the AppRole secret_id
+	VaultApproleMount string `ini:"vault_approle_mount"`  // AppRole auth mount, 'approle' is default
+	VaultKVMount      string `ini:"vault_kv_mount"`       // KV v2 secrets engine mount, 'secret' is default
+	VaultCertPath     string `ini:"vault_cert_path"`      // KV path holding certificate, private_key and optional chain fields
+	VaultPKIPath      string `ini:"vault_pki_path"`       // PKI issue endpoint, e.g. pki/issue/truenas
+	VaultCommonName   string `ini:"vault_common_name"`    // common name of a PKI issued certificate, defaults to the first domain or connect_host
+	VaultPKITTL       string `ini:"vault_pki_ttl"`        // requested TTL of a PKI issued certificate
+	VaultApiKeyPath   string `ini:"vault_api_key_path"`   // KV path holding the TrueNAS api_key
+	VaultApiKeyField  string `ini:"vault_api_key_field"`  // field of vault_api_key_path holding the api_key, 'api_key' is default
+}
+
+// UsesVault reports whether the section reads anything from Vault
+func (c *Config) UsesVault() bool {
+	return c.Source == SourceVault || c.VaultApiKeyPath != ""
+}
+
+// Options change how a config section is loaded
+type Options struct {
+	IdentityFile string   // age identity used to decrypt ENC[age:...] values, defaults to $TNASCERT_IDENTITY
+	Set          []string // key=value overrides from --set, applied after the environment
 }
 
 func New(config_file string, section string) (*Config, error) {
+	return NewWithOptions(config_file, section, Options{})
+}
+
+func NewWithOptions(config_file string, section string, opts Options) (*Config, error) {
+	c, err := mapSection(config_file, section, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.checkConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// mapSection loads a section without applying the defaults or checking it
+func mapSection(config_file string, section string, opts Options) (*Config, error) {
 	c := Config{}
 
 	// load the config file
-	cfg, err := ini.Load(config_file)
+	cfg, files, err := load(config_file)
 	if err != nil {
 		return nil, err
 	}
 
-	// lookup the config section
-	_, err = cfg.GetSection(section)
+	// lookup the config section and merge the settings it inherits and
+	// the overrides
+	sec, origins, err := resolveSection(cfg, section)
 	if err != nil {
 		return nil, err
 	}
+	if err = applyOverrides(sec, origins, section, opts); err != nil {
+		return nil, err
+	}
+
+	// decrypt any ENC[age:...] values before mapping them
+	c.encrypted, err = decryptSection(sec, opts.IdentityFile)
+	if err != nil {
+		return nil, fmt.Errorf("section %s, %v", section, err)
+	}
 
 	// map the config
-	err = cfg.Section(section).MapTo(&c)
+	err = sec.MapTo(&c)
 	if err != nil {
 		return nil, err
 	}
-
-	err = c.checkConfig()
+	c.Targets, err = mapFileTargets(cfg, c.FileTargets, opts)
 	if err != nil {
 		return nil, err
 	}
+	c.configFile = config_file
+	c.configFiles = files
+	c.origins = origins
 
 	return &c, nil
 }
 
+// decryptSection replaces every encrypted value in the section with its
+// plaintext and returns the names of the keys that were encrypted. The
+// identity is only loaded when there is something to decrypt.
+func decryptSection(sec *ini.Section, identityFile string) (map[string]bool, error) {
+	var identities []age.Identity
+	encrypted := map[string]bool{}
+
+	for _, key := range sec.Keys() {
+		if !IsEncrypted(key.Value()) {
+			continue
+		}
+		if identities == nil {
+			var err error
+			if identities, err = LoadIdentities(identityFile); err != nil {
+				return nil, err
+			}
+		}
+		plaintext, err := DecryptValue(key.Value(), identities)
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt %s, %v", key.Name(), err)
+		}
+		key.SetValue(plaintext)
+		encrypted[key.Name()] = true
+	}
+	return encrypted, nil
+}
+
+// load the config file and the files named by a top level include setting,
+// each may be ini, YAML or TOML
+func load(config_file string) (*ini.File, []string, error) {
+	cfg, err := loadFile(config_file)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := []string{config_file}
+	include := cfg.Section(ini.DefaultSection).Key("include").Strings(",")
+
+	// included files are loaded in order after the config file, a later file
+	// overrides the settings of a section defined earlier
+	dir := filepath.Dir(config_file)
+	for _, pattern := range include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid include %s, %v", pattern, err)
+		}
+		for _, match := range matches {
+			included, err := loadFile(match)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err = merge(cfg, included); err != nil {
+				return nil, nil, err
+			}
+			files = append(files, match)
+		}
+	}
+	return cfg, files, nil
+}
+
+// Sections returns the names of the sections defined in the config file and
+// the files it includes, other than the shared defaults
+func Sections(config_file string) ([]string, error) {
+	cfg, _, err := load(config_file)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range cfg.SectionStrings() {
+		if name == ini.DefaultSection || name == Defaults_section || strings.HasPrefix(name, FileTargetPrefix) {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
 func (c *Config) CertName() string {
 	if c.certName == "" {
 		c.certName = c.CertBasename + strftime.Format("-%Y-%m-%d-%s", time.Now())
@@ -92,6 +333,87 @@ func (c *Config) CertName() string {
 	return c.certName
 }
 
+// Bindings returns the services of bind, preceded by those of the
+// add_as_ui_certificate, add_as_ftp_certificate and add_as_app_certificate
+// settings
+func (c *Config) Bindings() []string {
+	var names []string
+	for _, legacy := range []struct {
+		set  bool
+		name string
+	}{{c.AddAsUiCertificate, BindUI}, {c.AddAsFTPCertificate, BindFTP}, {c.AddAsAppCertificate, BindApps}} {
+		if legacy.set {
+			names = append(names, legacy.name)
+		}
+	}
+	for _, name := range c.Bind {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Binds reports whether the certificate is bound to the named service
+func (c *Config) Binds(name string) bool {
+	return slices.Contains(c.Bindings(), name)
+}
+
+// AppPatterns returns the glob patterns selecting apps, app_name counts as
+// one more pattern
+func (c *Config) AppPatterns() []string {
+	patterns := append([]string{}, c.Apps...)
+	if c.AppName != "" {
+		patterns = append(patterns, c.AppName)
+	}
+	return patterns
+}
+
+// SelectsApp reports whether the certificate may be added to the named app,
+// every app is selected when neither apps nor app_name is set. With
+// app_selection = follow the app must also be using a certificate of
+// cert_basename, which is checked when deploying.
+func (c *Config) SelectsApp(name string) bool {
+	for _, pattern := range c.ExcludeApps {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
+	}
+	patterns := c.AppPatterns()
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CertField returns the path of the certificate id in the values of the named
+// app and whether it was configured. An app:path entry whose app pattern
+// matches wins over a plain path, network.certificate_id is the default.
+func (c *Config) CertField(app string) (string, bool) {
+	plain := ""
+	for _, entry := range c.CertFields {
+		pattern, field, found := strings.Cut(entry, ":")
+		if !found {
+			if plain == "" {
+				plain = pattern
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, app); ok {
+			return strings.TrimPrefix(field, "values."), true
+		}
+	}
+	if plain != "" {
+		return strings.TrimPrefix(plain, "values."), true
+	}
+	return Default_cert_field, false
+}
+
 func (c *Config) ServerURL() string {
 	if c.serverURL == "" {
 		c.serverURL = fmt.Sprintf("%s://%s:%d/%s", c.Protocol, c.ConnectHost, c.Port, endpoint)
@@ -99,16 +421,30 @@ func (c *Config) ServerURL() string {
 	return c.serverURL
 }
 
+// checkConfig applies the defaults and checks the section, reporting every
+// error found rather than only the first
 func (c *Config) checkConfig() error {
+	var errs []error
 	// if not the cert_basename is not defined use the default
 	if c.CertBasename == "" {
 		c.CertBasename = Default_base_cert_name
 	}
 	if c.ConnectHost == "" {
-		return fmt.Errorf("connect_host is not defined")
+		errs = append(errs, fmt.Errorf("connect_host is not defined"))
 	}
-	if c.FullChainPath == "" {
-		return fmt.Errorf("fullchain_path is not defined")
+	// any source other than file replaces the certificate and private key paths
+	if c.Source == SourceFile {
+		c.Source = ""
+	}
+	if c.Source != "" {
+		kind, _, _ := strings.Cut(c.Source, ":")
+		switch kind {
+		case SourceExec, SourceHTTP, SourceHTTPS, SourceStdin, SourceFD, SourceTraefik, SourceCaddy, SourceVault:
+		default:
+			errs = append(errs, fmt.Errorf("invalid source %s", c.Source))
+		}
+	} else if c.FullChainPath == "" {
+		errs = append(errs, fmt.Errorf("full_chain_path is not defined"))
 	}
 	// if port is not defined, use the default
 	if c.Port == 0 {
@@ -119,15 +455,124 @@ func (c *Config) checkConfig() error {
 		c.Protocol = Default_protocol
 	} else {
 		if c.Protocol != WS && c.Protocol != WSS {
-			return fmt.Errorf("invalid protocol")
+			errs = append(errs, fmt.Errorf("invalid protocol"))
 		}
 	}
-	if c.Private_key_path == "" {
-		return fmt.Errorf("private_key_path is not defined")
+	if c.Source == "" && c.Private_key_path == "" {
+		errs = append(errs, fmt.Errorf("private_key_path is not defined"))
 	}
 	if c.TimeoutSeconds <= 0 {
 		c.TimeoutSeconds = Default_timeout_seconds
 	}
+	for _, name := range c.Bind {
+		if !slices.Contains(BindNames, name) {
+			errs = append(errs, fmt.Errorf("invalid bind %s, use one of %s", name, strings.Join(BindNames, ", ")))
+		}
+	}
+	switch c.AppSelection {
+	case "":
+		c.AppSelection = AppSelectionPatterns
+	case AppSelectionPatterns, AppSelectionFollow:
+	default:
+		errs = append(errs, fmt.Errorf("invalid app_selection %s", c.AppSelection))
+	}
+	for _, pattern := range append(c.AppPatterns(), c.ExcludeApps...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("invalid app pattern %s", pattern))
+		}
+	}
+	if c.AppHealthTimeout <= 0 {
+		c.AppHealthTimeout = Default_app_health_timeout
+	}
+	if c.AppParallel <= 0 {
+		c.AppParallel = 1
+	}
+	if c.AppConnections <= 0 {
+		c.AppConnections = Default_app_connections
+	}
+	switch c.StoppedApps {
+	case "":
+		c.StoppedApps = StoppedAppsUpdate
+	case StoppedAppsSkip, StoppedAppsUpdate, StoppedAppsStart:
+	default:
+		errs = append(errs, fmt.Errorf("invalid stopped_apps %s", c.StoppedApps))
+	}
+	for _, entry := range c.CertFields {
+		pattern, field, found := strings.Cut(entry, ":")
+		if !found {
+			field = pattern
+		} else if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("invalid app pattern %s in cert_field", pattern))
+		}
+		if slices.Contains(strings.Split(field, "."), "") {
+			errs = append(errs, fmt.Errorf("invalid cert_field %s", entry))
+		}
+	}
+	for _, t := range c.Targets {
+		errs = append(errs, c.checkFileTarget(t)...)
+	}
+	if c.UsesVault() {
+		if err := c.checkVaultConfig(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := c.resolveApiKey(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if c.Username != "" {
+		log.Printf("using a password login as %s", c.apiKeySource)
+	} else if c.apiKeySource != "" {
+		log.Printf("using the api key from %s", c.apiKeySource)
+	}
 
 	return nil
 }
+
+func (c *Config) checkVaultConfig() error {
+	if c.VaultAddr == "" {
+		c.VaultAddr = os.Getenv("VAULT_ADDR")
+	}
+	if c.VaultAddr == "" {
+		return fmt.Errorf("vault_addr is not defined")
+	}
+	if c.VaultAuth == "" {
+		c.VaultAuth = VaultAuthToken
+	}
+	switch c.VaultAuth {
+	case VaultAuthToken, VaultAuthTokenFile:
+	case VaultAuthAppRole:
+		if c.VaultRoleID == "" {
+			return fmt.Errorf("vault_role_id is not defined")
+		}
+		if c.VaultSecretID == "" && c.VaultSecretIDFile == "" {
+			return fmt.Errorf("vault_secret_id or vault_secret_id_file is not defined")
+		}
+	default:
+		return fmt.Errorf("invalid vault_auth %s", c.VaultAuth)
+	}
+	if c.VaultApproleMount == "" {
+		c.VaultApproleMount = "approle"
+	}
+	if c.VaultKVMount == "" {
+		c.VaultKVMount = "secret"
+	}
+	if c.VaultApiKeyField == "" {
+		c.VaultApiKeyField = "api_key"
+	}
+	if c.Source == SourceVault {
+		if (c.VaultCertPath == "") == (c.VaultPKIPath == "") {
+			return fmt.Errorf("exactly one of vault_cert_path or vault_pki_path must be defined")
+		}
+		if c.VaultCommonName == "" {
+			if len(c.Domains) > 0 {
+				c.VaultCommonName = c.Domains[0]
+			} else {
+				c.VaultCommonName = c.ConnectHost
+			}
+		}
+	}
+	return nil
+}
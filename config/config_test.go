@@ -18,7 +18,11 @@
 package config
 
 import (
+	"filippo.io/age"
 	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -90,8 +94,521 @@ func TestNewConfig(t *testing.T) {
 		t.Errorf("Connect_host should be nas02.mydomain.com")
 	}
 
+	// test a section reading from a certificate source without file paths
+	if cfg, err = New(configFile, "traefik"); err != nil {
+		t.Errorf("New config failed with error: %v", err)
+	}
+	if cfg.Source != "traefik:/etc/traefik/acme.json#letsencrypt/nas04.mydomain.com" {
+		t.Errorf("Source should be traefik:/etc/traefik/acme.json#letsencrypt/nas04.mydomain.com")
+	}
+	// only source keeps a '#' or ';' not preceded by a space
+	if cfg.CertBasename != "letsencrypt" {
+		t.Errorf("CertBasename should be letsencrypt, got %s", cfg.CertBasename)
+	}
+
+	// test a section reading the certificate and api key from vault
+	if cfg, err = New(configFile, "vault"); err != nil {
+		t.Errorf("New config failed with error: %v", err)
+	}
+	if !cfg.UsesVault() {
+		t.Errorf("UsesVault should be true")
+	}
+	if cfg.VaultCommonName != "nas05.mydomain.com" {
+		t.Errorf("VaultCommonName should default to connect_host")
+	}
+	if cfg.VaultKVMount != "secret" || cfg.VaultApiKeyField != "api_key" {
+		t.Errorf("VaultKVMount and VaultApiKeyField should have their defaults")
+	}
+
 	// test loading a non-existent config section
 	if cfg, err = New(configFile, "nas10"); err == nil {
 		t.Errorf("New config failed with error: %v", err)
 	}
 }
+
+func TestApiKeySources(t *testing.T) {
+	dir := t.TempDir()
+	section := "[nas01]\nconnect_host = nas01.mydomain.com\nfull_chain_path = fullchain.pem\nprivate_key_path = privkey.pem\n"
+	writeFile := func(name string, data string, mode os.FileMode) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), mode); err != nil {
+			t.Fatalf("writing %s failed with error: %v", name, err)
+		}
+		os.Chmod(path, mode)
+		return path
+	}
+
+	// an inline key in a config file readable by others is refused
+	configFile := writeFile("inline.ini", section+"api_key = 1-inline\n", 0o644)
+	if _, err := New(configFile, "nas01"); err == nil {
+		t.Errorf("New should refuse an inline api_key in a world readable config file")
+	}
+	os.Chmod(configFile, 0o600)
+	if cfg, err := New(configFile, "nas01"); err != nil || cfg.Api_key != "1-inline" {
+		t.Errorf("New with an inline api_key failed with error: %v", err)
+	}
+
+	// api_key_file
+	keyFile := writeFile("api.key", "1-fromfile\n", 0o600)
+	configFile = writeFile("file.ini", section+"api_key_file = "+keyFile+"\n", 0o644)
+	cfg, err := New(configFile, "nas01")
+	if err != nil {
+		t.Fatalf("New with api_key_file failed with error: %v", err)
+	}
+	if cfg.Api_key != "1-fromfile" || !strings.HasPrefix(cfg.ApiKeySource(), "api_key_file") {
+		t.Errorf("api key should be read from api_key_file, source: %s", cfg.ApiKeySource())
+	}
+
+	// api_key_env
+	t.Setenv("TNAS_TEST_API_KEY", "1-fromenv")
+	configFile = writeFile("env.ini", section+"api_key_env = TNAS_TEST_API_KEY\n", 0o644)
+	if cfg, err = New(configFile, "nas01"); err != nil || cfg.Api_key != "1-fromenv" {
+		t.Errorf("New with api_key_env failed with error: %v", err)
+	}
+	if strings.Contains(cfg.ApiKeySource(), "1-fromenv") {
+		t.Errorf("ApiKeySource must not include the key")
+	}
+
+	// systemd credentials
+	credentials := filepath.Join(dir, "credentials")
+	os.Mkdir(credentials, 0o700)
+	writeFile("credentials/tnas-api-key", "1-fromcredential", 0o400)
+	configFile = writeFile("credential.ini", section+"api_key_credential = tnas-api-key\n", 0o644)
+	t.Setenv("CREDENTIALS_DIRECTORY", credentials)
+	if cfg, err = New(configFile, "nas01"); err != nil || cfg.Api_key != "1-fromcredential" {
+		t.Errorf("New with api_key_credential failed with error: %v", err)
+	}
+
+	// only one source may be used
+	configFile = writeFile("both.ini", section+"api_key_file = "+keyFile+"\napi_key_env = TNAS_TEST_API_KEY\n", 0o644)
+	if _, err = New(configFile, "nas01"); err == nil {
+		t.Errorf("New should refuse more than one api key source")
+	}
+
+	// username and password_file, with an optional TOTP secret
+	passwordFile := writeFile("password", "secret\n", 0o600)
+	otpFile := writeFile("otp", "gezd gnbv gy3t qojq gezd gnbv gy3t qojq\n", 0o600)
+	configFile = writeFile("password.ini", section+"username = admin\npassword_file = "+passwordFile+"\notp_secret_file = "+otpFile+"\n", 0o644)
+	if cfg, err = New(configFile, "nas01"); err != nil {
+		t.Fatalf("New with a username failed with error: %v", err)
+	}
+	if cfg.Password != "secret" || cfg.OtpSecret != "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" || cfg.TokenTTL != Default_token_ttl {
+		t.Errorf("unexpected password login settings %s, %d", cfg.OtpSecret, cfg.TokenTTL)
+	}
+	configFile = writeFile("nopassword.ini", section+"username = admin\n", 0o644)
+	if _, err = New(configFile, "nas01"); err == nil {
+		t.Errorf("New should refuse a username without a password_file")
+	}
+	os.Chmod(passwordFile, 0o644)
+	configFile = writeFile("openpassword.ini", section+"username = admin\npassword_file = "+passwordFile+"\n", 0o644)
+	if _, err = New(configFile, "nas01"); err == nil {
+		t.Errorf("New should refuse a password_file readable by others")
+	}
+	configFile = writeFile("keyandpassword.ini", section+"username = admin\npassword_file = "+passwordFile+"\napi_key_file = "+keyFile+"\n", 0o644)
+	if _, err = New(configFile, "nas01"); err == nil {
+		t.Errorf("New should refuse both a username and an api key")
+	}
+}
+
+func TestEncryptedValues(t *testing.T) {
+	dir := t.TempDir()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("GenerateX25519Identity failed with error: %v", err)
+	}
+	identityFile := filepath.Join(dir, "identity.txt")
+	if err = os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0o600); err != nil {
+		t.Fatalf("writing the identity failed with error: %v", err)
+	}
+
+	encrypted, err := EncryptValue("1-encrypted", []age.Recipient{identity.Recipient()})
+	if err != nil {
+		t.Fatalf("EncryptValue failed with error: %v", err)
+	}
+	if !IsEncrypted(encrypted) {
+		t.Errorf("IsEncrypted should be true for %s", encrypted)
+	}
+
+	// an encrypted api_key may live in a config file readable by others
+	configFile := filepath.Join(dir, "tnas-cert.ini")
+	data := "[nas01]\nconnect_host = nas01.mydomain.com\nfull_chain_path = fullchain.pem\nprivate_key_path = privkey.pem\napi_key = " + encrypted + "\n"
+	if err = os.WriteFile(configFile, []byte(data), 0o644); err != nil {
+		t.Fatalf("writing the config failed with error: %v", err)
+	}
+	os.Chmod(configFile, 0o644)
+
+	cfg, err := NewWithOptions(configFile, "nas01", Options{IdentityFile: identityFile})
+	if err != nil {
+		t.Fatalf("NewWithOptions failed with error: %v", err)
+	}
+	if cfg.Api_key != "1-encrypted" {
+		t.Errorf("api_key should have been decrypted")
+	}
+
+	// the identity may also come from the environment
+	t.Setenv(IdentityEnv, identityFile)
+	if cfg, err = New(configFile, "nas01"); err != nil || cfg.Api_key != "1-encrypted" {
+		t.Errorf("New with %s failed with error: %v", IdentityEnv, err)
+	}
+
+	// without an identity the value cannot be decrypted
+	t.Setenv(IdentityEnv, "")
+	if _, err = New(configFile, "nas01"); err == nil {
+		t.Errorf("New should fail without an identity")
+	}
+
+	// with the wrong identity the value cannot be decrypted
+	other, _ := age.GenerateX25519Identity()
+	otherFile := filepath.Join(dir, "other.txt")
+	os.WriteFile(otherFile, []byte(other.String()+"\n"), 0o600)
+	if _, err = NewWithOptions(configFile, "nas01", Options{IdentityFile: otherFile}); err == nil {
+		t.Errorf("NewWithOptions should fail with the wrong identity")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "tnas-cert.ini")
+	data := `# lab
+[good]
+connect_host = nas01.mydomain.com
+api_key = 1-secret
+skip_permission_checks = true
+full_chain_path = fullchain.pem
+private_key_path = privkey.pem
+
+[bad]
+connect_host = nas02.mydomain.com
+add_as_ui_certifcate = true
+debug = maybe
+protocol = ws
+cert_basename = my cert
+add_as_app_certificate = true
+bind = ui, nfs
+api_key = 1-secret
+skip_permission_checks = true
+`
+	if err := os.WriteFile(configFile, []byte(data), 0o600); err != nil {
+		t.Fatalf("writing the config failed with error: %v", err)
+	}
+
+	reports, err := Validate(configFile, nil, Options{})
+	if err != nil {
+		t.Fatalf("Validate failed with error: %v", err)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("expected 2 reports, got %d", len(reports))
+	}
+
+	good := reports[0]
+	if len(good.Errors) != 0 || good.Config == nil {
+		t.Errorf("section good should be valid, %v", good.Errors)
+	} else {
+		effective := good.Config.Effective("good")
+		if strings.Contains(effective, "1-secret") || !strings.Contains(effective, "api_key = ********") {
+			t.Errorf("the api key should be masked:\n%s", effective)
+		}
+		if !strings.Contains(effective, "port = 443") || !strings.Contains(effective, "protocol = wss") {
+			t.Errorf("the defaults should be applied:\n%s", effective)
+		}
+	}
+
+	// every problem in the section is reported
+	bad := strings.Join(reports[1].Errors, "\n")
+	for _, want := range []string{"did you mean add_as_ui_certificate", "debug = maybe", "full_chain_path is not defined",
+		"private_key_path is not defined", "cert_basename my cert", "invalid bind nfs"} {
+		if !strings.Contains(bad, want) {
+			t.Errorf("the errors of section bad should include %q:\n%s", want, bad)
+		}
+	}
+	if len(reports[1].Warnings) != 1 || reports[1].Config != nil {
+		t.Errorf("section bad should warn about protocol = ws, %v", reports[1].Warnings)
+	}
+
+	if reports, err = Validate(configFile, []string{"missing"}, Options{}); err != nil || len(reports[0].Errors) != 1 {
+		t.Errorf("a missing section should be reported")
+	}
+}
+
+func TestFileTargets(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "tnas-cert.ini")
+	data := `[defaults]
+connect_host = nas01.mydomain.com
+api_key = 1-secret
+skip_permission_checks = true
+full_chain_path = fullchain.pem
+private_key_path = privkey.pem
+
+[web]
+file_targets = nginx, plex
+
+[lab]
+file_targets = broken
+
+[file_target:nginx]
+cert_path = /mnt/tank/nginx/cert.pem
+key_path = /mnt/tank/nginx/key.pem
+mode = 0640
+restart_app = nginx
+
+[file_target:plex]
+format = pkcs12
+cert_path = /mnt/tank/plex/cert.p12
+password = secret
+restart = redeploy
+
+[file_target:broken]
+format = der
+cert_path = cert.der
+chain_path = /mnt/tank/chain.pem
+mode = 999
+restart = reload
+colour = red
+`
+	if err := os.WriteFile(configFile, []byte(data), 0o600); err != nil {
+		t.Fatalf("writing the config failed with error: %v", err)
+	}
+
+	if sections, err := Sections(configFile); err != nil || !reflect.DeepEqual(sections, []string{"web", "lab"}) {
+		t.Errorf("the file target sections should not be listed, %v, %v", sections, err)
+	}
+	cfg, err := New(configFile, "web")
+	if err != nil {
+		t.Fatalf("New config failed with error: %v", err)
+	}
+	if len(cfg.Targets) != 2 {
+		t.Fatalf("expected 2 file targets, got %d", len(cfg.Targets))
+	}
+	nginx, plex := cfg.Targets[0], cfg.Targets[1]
+	if nginx.Name != "nginx" || nginx.Format != FileFormatPEM || nginx.FileMode != 0o640 || nginx.Restart != RestartRestart {
+		t.Errorf("unexpected file target %+v", nginx)
+	}
+	if plex.Format != FileFormatPKCS12 || plex.Password != "secret" || plex.FileMode != Default_file_mode || plex.Restart != RestartRedeploy {
+		t.Errorf("unexpected file target %+v", plex)
+	}
+
+	reports, err := Validate(configFile, []string{"lab"}, Options{})
+	if err != nil {
+		t.Fatalf("Validate failed with error: %v", err)
+	}
+	errs := strings.Join(reports[0].Errors, "\n")
+	for _, want := range []string{"unknown key colour", "key_path is not defined", "chain_path is only used by the pem format",
+		"cert.der is not an absolute path", "invalid mode 999", "invalid restart reload"} {
+		if !strings.Contains(errs, want) {
+			t.Errorf("the errors of section lab should include %q:\n%s", want, errs)
+		}
+	}
+}
+
+func TestInheritance(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name string, data string) string {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0o700)
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatalf("writing %s failed with error: %v", name, err)
+		}
+		return path
+	}
+	configFile := writeFile("tnas-cert.ini", `include = conf.d/*.ini
+
+[defaults]
+api_key = 1-shared
+skip_permission_checks = true
+timeoutSeconds = 30
+
+[base]
+full_chain_path = /etc/letsencrypt/live/mydomain.com/fullchain.pem
+private_key_path = /etc/letsencrypt/live/mydomain.com/privkey.pem
+add_as_ui_certificate = true
+
+[nas01]
+extends = base
+connect_host = nas01.mydomain.com
+timeoutSeconds = 45
+
+[nas01.backup]
+extends = base
+connect_host = backup.mydomain.com
+
+[nas02]
+extends = nas01
+connect_host = nas02.mydomain.com
+timeoutSeconds = 60
+
+[loop1]
+extends = loop2
+
+[loop2]
+extends = loop1
+
+[orphan]
+extends = missing
+`)
+	writeFile("conf.d/nas03.ini", "[nas03]\nextends = base\nconnect_host = nas03.mydomain.com\n")
+
+	cfg, err := New(configFile, "nas02")
+	if err != nil {
+		t.Fatalf("New failed with error: %v", err)
+	}
+	if cfg.Api_key != "1-shared" || cfg.TimeoutSeconds != 60 || !cfg.AddAsUiCertificate || cfg.ConnectHost != "nas02.mydomain.com" {
+		t.Errorf("unexpected inherited settings %+v", cfg)
+	}
+	effective := cfg.Effective("nas02")
+	for _, want := range []string{"timeoutSeconds = 60\n", "add_as_ui_certificate = true ; from [base]", "api_key = ******** ; from [defaults]", "port = 443 ; default"} {
+		if !strings.Contains(effective, want) {
+			t.Errorf("the effective config should include %q:\n%s", want, effective)
+		}
+	}
+
+	// only extends names a base, a dotted section does not inherit its prefix
+	if cfg, err = New(configFile, "nas01.backup"); err != nil || cfg.TimeoutSeconds != 30 {
+		t.Errorf("nas01.backup should not inherit from nas01, %v", err)
+	}
+
+	// sections of included files
+	if cfg, err = New(configFile, "nas03"); err != nil || cfg.FullChainPath == "" {
+		t.Errorf("New for an included section failed with error: %v", err)
+	}
+	sections, _ := Sections(configFile)
+	if strings.Join(sections, ",") != "base,nas01,nas01.backup,nas02,loop1,loop2,orphan,nas03" {
+		t.Errorf("unexpected sections %v", sections)
+	}
+
+	if _, err = New(configFile, "loop1"); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("New should detect the extends cycle, %v", err)
+	}
+	if _, err = New(configFile, "orphan"); err == nil {
+		t.Errorf("New should fail for a missing base section")
+	}
+
+	// an inline api_key in an included file is held to the permission check
+	writeFile("open.ini", "include = conf.d/open.ini\n")
+	open := writeFile("conf.d/open.ini", "[open]\nconnect_host = nas04\napi_key = 1-open\nfull_chain_path = a\nprivate_key_path = b\n")
+	os.Chmod(open, 0o644)
+	if _, err = New(filepath.Join(dir, "open.ini"), "open"); err == nil {
+		t.Errorf("New should refuse an inline api_key in a world readable included file")
+	}
+}
+
+func TestFormats(t *testing.T) {
+	for _, configFile := range []string{"test_files/tnas-cert.yaml", "test_files/tnas-cert.toml"} {
+		sections, err := Sections(configFile)
+		if err != nil || strings.Join(sections, ",") != "nas01,nas02" {
+			t.Errorf("%s: unexpected sections %v, %v", configFile, sections, err)
+		}
+		cfg, err := New(configFile, "nas01")
+		if err != nil {
+			t.Fatalf("%s: New failed with error: %v", configFile, err)
+		}
+		if cfg.Port != 8080 || !cfg.AddAsUiCertificate || cfg.TimeoutSeconds != 30 || cfg.Api_key != "test" {
+			t.Errorf("%s: unexpected settings %+v", configFile, cfg)
+		}
+		if strings.Join(cfg.Domains, ",") != "nas01.mydomain.com,www.mydomain.com" {
+			t.Errorf("%s: unexpected domains %v", configFile, cfg.Domains)
+		}
+		if cfg, err = New(configFile, "nas02"); err != nil || cfg.Port != 8080 || cfg.AddAsUiCertificate {
+			t.Errorf("%s: unexpected inherited settings, %v", configFile, err)
+		}
+	}
+
+	// every section converted to YAML loads the same as the ini section
+	data, err := ConvertToYAML("test_files/tnas-cert.ini")
+	if err != nil {
+		t.Fatalf("ConvertToYAML failed with error: %v", err)
+	}
+	converted := filepath.Join(t.TempDir(), "tnas-cert.yaml")
+	if err = os.WriteFile(converted, data, 0o600); err != nil {
+		t.Fatalf("writing the converted config failed with error: %v", err)
+	}
+	sections, _ := Sections("test_files/tnas-cert.ini")
+	for _, section := range sections {
+		want, err := New("test_files/tnas-cert.ini", section)
+		if err != nil {
+			continue
+		}
+		got, err := New(converted, section)
+		if err != nil {
+			t.Errorf("section %s of the converted config failed with error: %v", section, err)
+			continue
+		}
+		if want.Effective(section) != got.Effective(section) {
+			t.Errorf("section %s differs after conversion:\n%s\n%s", section, want.Effective(section), got.Effective(section))
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+	schema, err := Schema()
+	if err != nil {
+		t.Fatalf("Schema failed with error: %v", err)
+	}
+	// the published schema must be regenerated when a setting changes, with
+	// tnascert-deploy config schema > tnas-cert.schema.json
+	published, err := os.ReadFile("../tnas-cert.schema.json")
+	if err != nil {
+		t.Fatalf("reading the published schema failed with error: %v", err)
+	}
+	if string(schema) != string(published) {
+		t.Errorf("tnas-cert.schema.json is out of date")
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	configFile := "test_files/tnas-cert.ini"
+
+	// TNASCERT_<KEY> < TNASCERT_<SECTION>_<KEY> < --set
+	t.Setenv("TNASCERT_CONNECT_HOST", "env.mydomain.com")
+	t.Setenv("TNASCERT_TIMEOUTSECONDS", "45")
+	t.Setenv("TNASCERT_NAS02_CONNECT_HOST", "nas02-env.mydomain.com")
+	cfg, err := NewWithOptions(configFile, "nas02", Options{Set: []string{"timeoutSeconds=90", "domains=a.mydomain.com,b.mydomain.com"}})
+	if err != nil {
+		t.Fatalf("NewWithOptions failed with error: %v", err)
+	}
+	if cfg.ConnectHost != "nas02-env.mydomain.com" || cfg.TimeoutSeconds != 90 || len(cfg.Domains) != 2 {
+		t.Errorf("unexpected overridden settings %s, %d, %v", cfg.ConnectHost, cfg.TimeoutSeconds, cfg.Domains)
+	}
+	if cfg, err = New(configFile, "default"); err != nil || cfg.ConnectHost != "env.mydomain.com" || cfg.TimeoutSeconds != 45 {
+		t.Errorf("the TNASCERT_<KEY> overrides should apply to every section, %v", err)
+	}
+
+	// overrides are marked and secrets masked in the effective config
+	t.Setenv("TNASCERT_API_KEY", "1-fromenv")
+	cfg, err = New(configFile, "default")
+	if err != nil {
+		t.Fatalf("New failed with error: %v", err)
+	}
+	effective := cfg.Effective("default")
+	if !strings.Contains(effective, "api_key = ******** ; from $TNASCERT_API_KEY") || strings.Contains(effective, "1-fromenv") {
+		t.Errorf("the api_key override should be masked:\n%s", effective)
+	}
+	if !strings.Contains(effective, "connect_host = env.mydomain.com ; from $TNASCERT_CONNECT_HOST") {
+		t.Errorf("the connect_host override should be marked:\n%s", effective)
+	}
+
+	// the app patterns are checked
+	cfg, err = NewWithOptions(configFile, "default", Options{Set: []string{"apps=nextcloud, minio-*", "exclude_apps=*-test"}})
+	if err != nil || len(cfg.Apps) != 2 || !cfg.SelectsApp("minio-a") || cfg.SelectsApp("minio-test") {
+		t.Errorf("unexpected app selection %v, %v", cfg.Apps, err)
+	}
+
+	// a per app cert_field wins over a plain one
+	cfg, err = NewWithOptions(configFile, "default", Options{Set: []string{"cert_field=tls.certificate_id, nextcloud:values.nextcloud.certificate_id"}})
+	if err != nil {
+		t.Fatalf("NewWithOptions failed with error: %v", err)
+	}
+	for app, want := range map[string]string{"nextcloud": "nextcloud.certificate_id", "immich": "tls.certificate_id"} {
+		if field, ok := cfg.CertField(app); field != want || !ok {
+			t.Errorf("CertField(%s) returned %s, %v", app, field, ok)
+		}
+	}
+	cfg.CertFields = nil
+	if field, ok := cfg.CertField("immich"); field != Default_cert_field || ok {
+		t.Errorf("CertField(immich) returned %s, %v", field, ok)
+	}
+
+	for _, set := range []string{"connect_hots=x", "no-equals", "apps=minio-[", "app_selection=all", "cert_field=tls..certificate_id", "stopped_apps=restart"} {
+		if _, err = NewWithOptions(configFile, "default", Options{Set: []string{set}}); err == nil {
+			t.Errorf("NewWithOptions should refuse --set %s", set)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"gopkg.in/ini.v1"
+	"strconv"
+	"strings"
+)
+
+// file target sections are named [file_target:name] and listed by file_targets
+const FileTargetPrefix = "file_target:"
+
+// output formats of a file target
+const (
+	FileFormatPEM      = "pem"
+	FileFormatCombined = "combined"
+	FileFormatDER      = "der"
+	FileFormatPKCS12   = "pkcs12"
+)
+
+// how restart_app is restarted after its files changed
+const (
+	RestartRestart  = "restart"
+	RestartRedeploy = "redeploy"
+)
+
+const Default_file_mode = 0o600
+
+// FileTarget is a [file_target:name] section, NAS paths the certificate and
+// key are written to for services that read them from disk
+type FileTarget struct {
+	Name         string `ini:"-"`             // the name after file_target:
+	Format       string `ini:"format"`        // 'pem', 'combined', 'der' or 'pkcs12', 'pem' is default
+	CertPath     string `ini:"cert_path"`     // the certificate, with its chain unless chain_path is set, or the combined or PKCS#12 file
+	KeyPath      string `ini:"key_path"`      // the private key, for pem and der
+	ChainPath    string `ini:"chain_path"`    // the chain, for pem
+	Owner        string `ini:"owner"`         // user name or uid owning the files
+	Group        string `ini:"group"`         // group name or gid of the files
+	Mode         string `ini:"mode"`          // octal mode of the files, 0600 is default
+	Password     string `ini:"password"`      // password of a PKCS#12 file
+	PasswordFile string `ini:"password_file"` // local file holding the password of a PKCS#12 file
+	RestartApp   string `ini:"restart_app"`   // app restarted when the files changed
+	Restart      string `ini:"restart"`       // 'restart' or 'redeploy', 'restart' is default
+	Extends      string `ini:"extends"`       // file_target section whose settings this one inherits
+	FileMode     uint32 `ini:"-"`             // parsed from mode
+}
+
+// map the file_targets sections of a config section, decrypting their values
+func mapFileTargets(file *ini.File, names []string, opts Options) ([]*FileTarget, error) {
+	var targets []*FileTarget
+	for _, name := range names {
+		sec, _, err := resolveSection(file, FileTargetPrefix+name)
+		if err != nil {
+			return nil, fmt.Errorf("file target %s, %v", name, err)
+		}
+		if _, err = decryptSection(sec, opts.IdentityFile); err != nil {
+			return nil, fmt.Errorf("file target %s, %v", name, err)
+		}
+		t := &FileTarget{Name: name}
+		if err = sec.MapTo(t); err != nil {
+			return nil, fmt.Errorf("file target %s, %v", name, err)
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// check a file target, applying its defaults and reading password_file
+func (c *Config) checkFileTarget(t *FileTarget) []error {
+	var errs []error
+	errorf := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("file target %s, "+format, append([]interface{}{t.Name}, args...)...))
+	}
+
+	if t.Format == "" {
+		t.Format = FileFormatPEM
+	}
+	if t.CertPath == "" {
+		errorf("cert_path is not defined")
+	}
+	switch t.Format {
+	case FileFormatPEM, FileFormatDER:
+		if t.KeyPath == "" {
+			errorf("key_path is not defined")
+		}
+		if t.Format == FileFormatDER && t.ChainPath != "" {
+			errorf("a der file holds one certificate, chain_path is only used by the %s format", FileFormatPEM)
+		}
+	case FileFormatCombined, FileFormatPKCS12:
+		if t.KeyPath != "" || t.ChainPath != "" {
+			errorf("the %s format is written to cert_path only", t.Format)
+		}
+	default:
+		errorf("invalid format %s", t.Format)
+	}
+	for _, path := range []string{t.CertPath, t.KeyPath, t.ChainPath} {
+		if path != "" && !strings.HasPrefix(path, "/") {
+			errorf("%s is not an absolute path", path)
+		}
+	}
+
+	t.FileMode = Default_file_mode
+	if t.Mode != "" {
+		mode, err := strconv.ParseUint(t.Mode, 8, 32)
+		if err != nil || mode > 0o777 {
+			errorf("invalid mode %s", t.Mode)
+		}
+		t.FileMode = uint32(mode)
+	}
+
+	if t.PasswordFile != "" {
+		if err := c.checkSecretFile(t.PasswordFile, "password_file"); err != nil {
+			errorf("%v", err)
+		} else if password, err := readSecret(t.PasswordFile); err != nil {
+			errorf("could not read password_file, %v", err)
+		} else {
+			t.Password = password
+		}
+	}
+	if t.Format != FileFormatPKCS12 && (t.Password != "" || t.PasswordFile != "") {
+		errorf("a password is only used by the %s format", FileFormatPKCS12)
+	}
+
+	switch t.Restart {
+	case "":
+		t.Restart = RestartRestart
+	case RestartRestart, RestartRedeploy:
+	default:
+		errorf("invalid restart %s", t.Restart)
+	}
+	return errs
+}
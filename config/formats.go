@@ -0,0 +1,280 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// a setting read from a YAML or TOML file, in file order
+type setting struct {
+	section string
+	key     string
+	value   interface{}
+}
+
+// loadFile reads one config file into ini sections, YAML and TOML files are
+// mapped so that a table is a section and a top level value is a setting of
+// the unnamed section, like include
+func loadFile(path string) (*ini.File, error) {
+	var settings []setting
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		settings, err = readYAML(path)
+	case ".toml":
+		settings, err = readTOML(path)
+	default:
+		return loadINI(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s, %v", path, err)
+	}
+
+	file := ini.Empty()
+	for _, s := range settings {
+		sec, err := file.GetSection(s.section)
+		if err != nil {
+			if sec, err = file.NewSection(s.section); err != nil {
+				return nil, err
+			}
+		}
+		if s.key == "" {
+			continue
+		}
+		if err = setValue(sec, s.key, s.value); err != nil {
+			return nil, fmt.Errorf("%s: section %s, %v", path, s.section, err)
+		}
+	}
+	return file, nil
+}
+
+// the settings whose values may hold a '#', in them an inline comment must be
+// preceded by a space as in source = traefik:/path/acme.json#resolver/domain
+var spacedCommentKeys = []string{"source"}
+
+// loadINI reads an ini file where '#' and ';' start an inline comment, except
+// in the spacedCommentKeys settings which are read again keeping them
+func loadINI(path string) (*ini.File, error) {
+	file, err := ini.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	spaced, err := ini.LoadSources(ini.LoadOptions{SpaceBeforeInlineComment: true}, path)
+	if err != nil {
+		return nil, err
+	}
+	for _, sec := range spaced.Sections() {
+		for _, name := range spacedCommentKeys {
+			if sec.HasKey(name) {
+				file.Section(sec.Name()).Key(name).SetValue(sec.Key(name).Value())
+			}
+		}
+	}
+	return file, nil
+}
+
+func readYAML(path string) ([]setting, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("the document must be a mapping of sections")
+	}
+
+	var settings []setting
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		name, node := root.Content[i].Value, root.Content[i+1]
+		if node.Kind != yaml.MappingNode {
+			var value interface{}
+			if err = node.Decode(&value); err != nil {
+				return nil, err
+			}
+			settings = append(settings, setting{section: ini.DefaultSection, key: name, value: value})
+			continue
+		}
+		// an empty section is still a section
+		settings = append(settings, setting{section: name})
+		for j := 0; j+1 < len(node.Content); j += 2 {
+			var value interface{}
+			if err = node.Content[j+1].Decode(&value); err != nil {
+				return nil, err
+			}
+			settings = append(settings, setting{section: name, key: node.Content[j].Value, value: value})
+		}
+	}
+	return settings, nil
+}
+
+func readTOML(path string) ([]setting, error) {
+	var doc map[string]interface{}
+	md, err := toml.DecodeFile(path, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var settings []setting
+	for _, key := range md.Keys() {
+		switch len(key) {
+		case 1:
+			if _, ok := doc[key[0]].(map[string]interface{}); ok {
+				settings = append(settings, setting{section: key[0]})
+			} else {
+				settings = append(settings, setting{section: ini.DefaultSection, key: key[0], value: doc[key[0]]})
+			}
+		case 2:
+			table, _ := doc[key[0]].(map[string]interface{})
+			settings = append(settings, setting{section: key[0], key: key[1], value: table[key[1]]})
+		default:
+			return nil, fmt.Errorf("%s is nested too deeply, sections hold only settings", key)
+		}
+	}
+	return settings, nil
+}
+
+// setValue stores a YAML or TOML value as an ini value, lists are joined
+// with the ini list delimiter
+func setValue(sec *ini.Section, key string, value interface{}) error {
+	var s string
+	switch v := value.(type) {
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			if _, ok := item.(map[string]interface{}); ok {
+				return fmt.Errorf("%s must be a list of values", key)
+			}
+			str := fmt.Sprint(item)
+			if strings.Contains(str, ",") {
+				return fmt.Errorf("%s: list items may not contain ','", key)
+			}
+			items = append(items, str)
+		}
+		s = strings.Join(items, ",")
+	case map[string]interface{}:
+		return fmt.Errorf("%s may not be a table", key)
+	case nil:
+		s = ""
+	default:
+		s = fmt.Sprint(v)
+	}
+	_, err := sec.NewKey(key, s)
+	return err
+}
+
+// merge copies the sections and settings of src into dst, overriding the
+// settings dst already has
+func merge(dst *ini.File, src *ini.File) error {
+	for _, sec := range src.Sections() {
+		target, err := dst.GetSection(sec.Name())
+		if err != nil {
+			if target, err = dst.NewSection(sec.Name()); err != nil {
+				return err
+			}
+		}
+		for _, key := range sec.Keys() {
+			if _, err = target.NewKey(key.Name(), key.Value()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ConvertToYAML converts an ini config file to YAML. The include setting and
+// the section and key order are kept, list settings become YAML lists and
+// settings known to be booleans or numbers are written unquoted. Comments
+// are not carried over.
+func ConvertToYAML(config_file string) ([]byte, error) {
+	file, err := loadINI(config_file)
+	if err != nil {
+		return nil, err
+	}
+	fields := settingFields()
+
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	for _, sec := range file.Sections() {
+		var target *yaml.Node
+		if sec.Name() == ini.DefaultSection {
+			target = doc
+		} else {
+			target = &yaml.Node{Kind: yaml.MappingNode}
+			doc.Content = append(doc.Content, scalarNode(sec.Name(), "!!str"), target)
+		}
+		for _, key := range sec.Keys() {
+			var value *yaml.Node
+			field, ok := fields[key.Name()]
+			kind := reflect.String
+			if ok {
+				kind = field.Type.Kind()
+			}
+			switch {
+			case key.Name() == "include" || kind == reflect.Slice:
+				value = &yaml.Node{Kind: yaml.SequenceNode}
+				for _, item := range key.Strings(",") {
+					value.Content = append(value.Content, scalarNode(item, "!!str"))
+				}
+			case kind == reflect.Bool && !IsEncrypted(key.Value()):
+				b, err := key.Bool()
+				if err != nil {
+					return nil, fmt.Errorf("section %s, %s = %s is not a valid bool", sec.Name(), key.Name(), key.Value())
+				}
+				value = scalarNode(fmt.Sprint(b), "!!bool")
+			case (kind == reflect.Int64 || kind == reflect.Uint64) && !IsEncrypted(key.Value()):
+				if _, err := key.Int64(); err != nil {
+					return nil, fmt.Errorf("section %s, %s = %s is not a valid number", sec.Name(), key.Name(), key.Value())
+				}
+				value = scalarNode(key.Value(), "!!int")
+			default:
+				value = scalarNode(key.Value(), "!!str")
+			}
+			target.Content = append(target.Content, scalarNode(key.Name(), "!!str"), value)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err = enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	if err = enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func scalarNode(value string, tag string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value}
+}
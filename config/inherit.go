@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"gopkg.in/ini.v1"
+	"strings"
+)
+
+// resolveSection merges the settings a section inherits into a new section:
+// the [defaults] section first, then the sections it extends, furthest base
+// first, and last its own settings. The origins map each setting to the
+// section it came from.
+func resolveSection(file *ini.File, name string) (*ini.Section, map[string]string, error) {
+	if _, err := file.GetSection(name); err != nil {
+		return nil, nil, err
+	}
+
+	var order []string
+	values := map[string]string{}
+	origins := map[string]string{}
+	set := func(sec *ini.Section) {
+		for _, key := range sec.Keys() {
+			if _, ok := values[key.Name()]; !ok {
+				order = append(order, key.Name())
+			}
+			values[key.Name()] = key.Value()
+			origins[key.Name()] = sec.Name()
+		}
+	}
+
+	// the defaults are deployment settings, file targets do not take them
+	if defaults, err := file.GetSection(Defaults_section); err == nil && name != Defaults_section && !strings.HasPrefix(name, FileTargetPrefix) {
+		set(defaults)
+	}
+	if err := inherit(file, name, nil, set); err != nil {
+		return nil, nil, err
+	}
+
+	merged := ini.Empty()
+	sec, err := merged.NewSection(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, key := range order {
+		if _, err = sec.NewKey(key, values[key]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return sec, origins, nil
+}
+
+// inherit applies the bases of a section and then the section itself
+func inherit(file *ini.File, name string, chain []string, set func(*ini.Section)) error {
+	for _, seen := range chain {
+		if seen == name {
+			return fmt.Errorf("extends cycle %s -> %s", strings.Join(chain, " -> "), name)
+		}
+	}
+	sec, err := file.GetSection(name)
+	if err != nil {
+		return fmt.Errorf("section %s extends %s which does not exist", chain[len(chain)-1], name)
+	}
+	chain = append(chain, name)
+
+	if base := sec.Key("extends").String(); base != "" {
+		if err := inherit(file, base, chain, set); err != nil {
+			return err
+		}
+	}
+	set(sec)
+	return nil
+}
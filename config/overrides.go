@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"gopkg.in/ini.v1"
+	"os"
+	"strings"
+)
+
+// EnvPrefix starts the environment variables that override settings
+const EnvPrefix = "TNASCERT_"
+
+// envName is the environment variable overriding a setting, for every
+// section when section is empty. Letters are upper cased and anything other
+// than a letter or digit becomes '_'.
+func envName(section string, key string) string {
+	name := key
+	if section != "" {
+		name = section + "_" + key
+	}
+	return EnvPrefix + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// applyOverrides layers the environment and --set overrides on top of the
+// resolved section, in this order, each overriding the last:
+//
+//	TNASCERT_<KEY>
+//	TNASCERT_<SECTION>_<KEY>
+//	--set key=value
+func applyOverrides(sec *ini.Section, origins map[string]string, section string, opts Options) error {
+	set := func(key string, value string, origin string) {
+		sec.Key(key).SetValue(value)
+		origins[key] = origin
+	}
+
+	fields := settingFields()
+	for _, scope := range []string{"", section} {
+		for key := range fields {
+			name := envName(scope, key)
+			if value, ok := os.LookupEnv(name); ok {
+				set(key, value, "$"+name)
+			}
+		}
+	}
+
+	for _, arg := range opts.Set {
+		key, value, ok := strings.Cut(arg, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return fmt.Errorf("invalid --set %s, use key=value", arg)
+		}
+		if _, known := fields[key]; !known {
+			if suggestion := closestKey(key, fields); suggestion != "" {
+				return fmt.Errorf("unknown key %s in --set, did you mean %s?", key, suggestion)
+			}
+			return fmt.Errorf("unknown key %s in --set", key)
+		}
+		set(key, strings.TrimSpace(value), "--set")
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// settings limited to a fixed set of values
+var schemaEnums = map[string][]string{
+	"app_selection": {AppSelectionPatterns, AppSelectionFollow},
+	"protocol":      {WS, WSS},
+	"stopped_apps":  {StoppedAppsSkip, StoppedAppsUpdate, StoppedAppsStart},
+	"vault_auth":    {VaultAuthToken, VaultAuthTokenFile, VaultAuthAppRole},
+}
+
+// Schema returns a JSON Schema for YAML and TOML config files, generated from
+// the settings of Config. Settings that are not strings may also be given as
+// an ENC[age:...] string.
+func Schema() ([]byte, error) {
+	section := map[string]interface{}{"$ref": "#/$defs/section"}
+	schema := map[string]interface{}{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"title":       "tnascert-deploy configuration",
+		"description": "Each table is a config section, [defaults] applies to every section.",
+		"type":        "object",
+		"properties": map[string]interface{}{
+			"include": map[string]interface{}{
+				"description": "config files to load after this one, relative to its directory",
+				"anyOf": []interface{}{
+					map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+					map[string]interface{}{"type": "string"},
+				},
+			},
+			Defaults_section: section,
+		},
+		"patternProperties": map[string]interface{}{
+			"^" + FileTargetPrefix: map[string]interface{}{"$ref": "#/$defs/file_target"},
+		},
+		"additionalProperties": section,
+		"$defs": map[string]interface{}{
+			"section": map[string]interface{}{
+				"type":                 "object",
+				"properties":           schemaProperties(settingFields()),
+				"additionalProperties": false,
+			},
+			"file_target": map[string]interface{}{
+				"type":                 "object",
+				"properties":           schemaProperties(fileTargetFields()),
+				"additionalProperties": false,
+			},
+			"encrypted": map[string]interface{}{
+				"type":    "string",
+				"pattern": `^ENC\[age:[A-Za-z0-9+/=]+\]$`,
+			},
+		},
+	}
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// the schema properties of the settings of a section
+func schemaProperties(fields map[string]reflect.StructField) map[string]interface{} {
+	encrypted := map[string]interface{}{"$ref": "#/$defs/encrypted"}
+	properties := map[string]interface{}{}
+	for name, field := range fields {
+		var property map[string]interface{}
+		switch field.Type.Kind() {
+		case reflect.Bool:
+			property = map[string]interface{}{"anyOf": []interface{}{map[string]interface{}{"type": "boolean"}, encrypted}}
+		case reflect.Int, reflect.Int64:
+			property = map[string]interface{}{"anyOf": []interface{}{map[string]interface{}{"type": "integer"}, encrypted}}
+		case reflect.Uint64:
+			property = map[string]interface{}{"anyOf": []interface{}{map[string]interface{}{"type": "integer", "minimum": 0}, encrypted}}
+		case reflect.Slice:
+			property = map[string]interface{}{"anyOf": []interface{}{
+				map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+				map[string]interface{}{"type": "string"},
+			}}
+		default:
+			property = map[string]interface{}{"type": "string"}
+			if values, ok := schemaEnums[name]; ok {
+				property["enum"] = values
+			}
+		}
+		properties[name] = property
+	}
+	return properties
+}
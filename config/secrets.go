@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"filippo.io/age"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	encPrefix   = "ENC[age:"
+	encSuffix   = "]"
+	IdentityEnv = "TNASCERT_IDENTITY" // environment variable naming the age identity file
+)
+
+// IsEncrypted reports whether a config value is an ENC[age:...] value
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, encPrefix) && strings.HasSuffix(value, encSuffix)
+}
+
+// LoadIdentities reads the age identities used to decrypt config values from
+// path, or from the file named by $TNASCERT_IDENTITY when path is empty
+func LoadIdentities(path string) ([]age.Identity, error) {
+	if path == "" {
+		path = os.Getenv(IdentityEnv)
+	}
+	if path == "" {
+		return nil, fmt.Errorf("no age identity, use --identity or set %s", IdentityEnv)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the age identity file, %v", err)
+	}
+	defer f.Close()
+
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the age identity file %s, %v", path, err)
+	}
+	return identities, nil
+}
+
+// ParseRecipients parses age recipients given as age1... public keys or as
+// files holding recipients or identities, whose public keys are used
+func ParseRecipients(args []string) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "age1") {
+			r, err := age.ParseX25519Recipient(arg)
+			if err != nil {
+				return nil, err
+			}
+			recipients = append(recipients, r)
+			continue
+		}
+
+		data, err := os.ReadFile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the recipients file, %v", err)
+		}
+		if rs, err := age.ParseRecipients(bytes.NewReader(data)); err == nil {
+			recipients = append(recipients, rs...)
+			continue
+		}
+		identities, err := age.ParseIdentities(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s holds neither age recipients nor identities", arg)
+		}
+		for _, id := range identities {
+			if x, ok := id.(*age.X25519Identity); ok {
+				recipients = append(recipients, x.Recipient())
+			}
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no age recipients")
+	}
+	return recipients, nil
+}
+
+// EncryptValue encrypts a config value to the recipients as ENC[age:...]
+func EncryptValue(plaintext string, recipients []age.Recipient) (string, error) {
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipients...)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.WriteString(w, plaintext); err != nil {
+		return "", err
+	}
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+	return encPrefix + base64.StdEncoding.EncodeToString(buf.Bytes()) + encSuffix, nil
+}
+
+// DecryptValue decrypts an ENC[age:...] config value
+func DecryptValue(value string, identities []age.Identity) (string, error) {
+	if !IsEncrypted(value) {
+		return "", fmt.Errorf("not an %s...%s value", encPrefix, encSuffix)
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(strings.TrimPrefix(value, encPrefix), encSuffix))
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value, %v", err)
+	}
+	r, err := age.Decrypt(bytes.NewReader(data), identities...)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,273 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// TrueNAS certificate names may only hold letters, digits, '-' and '_'
+var certNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// settings whose values are masked in the effective config
+var secretKeys = map[string]bool{
+	"api_key":         true,
+	"source_token":    true,
+	"vault_token":     true,
+	"vault_secret_id": true,
+}
+
+// SectionReport is the result of validating one config section
+type SectionReport struct {
+	Section  string
+	Config   *Config // the section with the defaults applied, nil if it could not be loaded
+	Errors   []string
+	Warnings []string
+}
+
+func (r *SectionReport) errorf(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+func (r *SectionReport) warnf(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Validate checks the named sections, or every section when none are named,
+// collecting all of the errors in each rather than stopping at the first
+func Validate(config_file string, sections []string, opts Options) ([]*SectionReport, error) {
+	file, _, err := load(config_file)
+	if err != nil {
+		return nil, err
+	}
+	if len(sections) == 0 {
+		if sections, err = Sections(config_file); err != nil {
+			return nil, err
+		}
+	}
+
+	fields := settingFields()
+	var reports []*SectionReport
+	for _, section := range sections {
+		report := &SectionReport{Section: section}
+		reports = append(reports, report)
+
+		sec, origins, err := resolveSection(file, section)
+		if err == nil {
+			err = applyOverrides(sec, origins, section, opts)
+		}
+		if err != nil {
+			report.errorf("%v", err)
+			continue
+		}
+		for _, key := range sec.Keys() {
+			name := key.Name()
+			if origin := origins[name]; origin != section {
+				if !strings.HasPrefix(origin, "$") && origin != "--set" {
+					origin = "[" + origin + "]"
+				}
+				name = fmt.Sprintf("%s (from %s)", name, origin)
+			}
+			field, ok := fields[key.Name()]
+			if !ok {
+				if suggestion := closestKey(key.Name(), fields); suggestion != "" {
+					report.errorf("unknown key %s, did you mean %s?", name, suggestion)
+				} else {
+					report.errorf("unknown key %s", name)
+				}
+				continue
+			}
+			if IsEncrypted(key.Value()) {
+				continue
+			}
+			var err error
+			switch field.Type.Kind() {
+			case reflect.Bool:
+				_, err = key.Bool()
+			case reflect.Int, reflect.Int64:
+				_, err = key.Int64()
+			case reflect.Uint64:
+				_, err = key.Uint64()
+			}
+			if err != nil {
+				report.errorf("%s = %s is not a valid %s", name, key.Value(), field.Type.Kind())
+			}
+		}
+
+		c, err := mapSection(config_file, section, opts)
+		if err != nil {
+			report.errorf("%v", err)
+			continue
+		}
+		targetFields := fileTargetFields()
+		for _, name := range c.FileTargets {
+			sec, _, err := resolveSection(file, FileTargetPrefix+name)
+			if err != nil {
+				continue
+			}
+			for _, key := range sec.Keys() {
+				if _, ok := targetFields[key.Name()]; ok {
+					continue
+				}
+				if suggestion := closestKey(key.Name(), targetFields); suggestion != "" {
+					report.errorf("file target %s, unknown key %s, did you mean %s?", name, key.Name(), suggestion)
+				} else {
+					report.errorf("file target %s, unknown key %s", name, key.Name())
+				}
+			}
+		}
+		if err = c.checkConfig(); err != nil {
+			for _, e := range splitErrors(err) {
+				report.errorf("%v", e)
+			}
+		}
+		if !certNameRe.MatchString(c.CertBasename) {
+			report.errorf("cert_basename %s may only contain letters, digits, '-' and '_'", c.CertBasename)
+		}
+		if c.Protocol == WS {
+			if c.Username != "" {
+				report.warnf("protocol = ws sends the password of %s in plain text", c.Username)
+			} else {
+				report.warnf("protocol = ws sends the api key in plain text and TrueNAS revokes api keys used that way")
+			}
+		}
+		if len(report.Errors) == 0 {
+			report.Config = c
+		}
+	}
+	return reports, nil
+}
+
+// Effective returns the section as ini text with the defaults applied and
+// the secrets and any values that were encrypted masked. Each setting not
+// defined in the section itself is commented with where it came from.
+func (c *Config) Effective(section string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s]\n", section)
+	c.writeSettings(&b, section, reflect.ValueOf(c).Elem())
+	return b.String()
+}
+
+func (c *Config) writeSettings(b *strings.Builder, section string, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, opt, _ := strings.Cut(field.Tag.Get("ini"), ",")
+		if opt == "extends" {
+			c.writeSettings(b, section, v.Field(i))
+			continue
+		}
+		if name == "" || name == "-" || v.Field(i).IsZero() {
+			continue
+		}
+		value := fmt.Sprint(v.Field(i).Interface())
+		if list, ok := v.Field(i).Interface().([]string); ok {
+			value = strings.Join(list, ", ")
+		}
+		if secretKeys[name] || c.encrypted[name] {
+			value = "********"
+		}
+		switch origin, ok := c.origins[name]; {
+		case !ok:
+			fmt.Fprintf(b, "%s = %s ; default\n", name, value)
+		case strings.HasPrefix(origin, "$") || origin == "--set":
+			fmt.Fprintf(b, "%s = %s ; from %s\n", name, value, origin)
+		case origin != section:
+			fmt.Fprintf(b, "%s = %s ; from [%s]\n", name, value, origin)
+		default:
+			fmt.Fprintf(b, "%s = %s\n", name, value)
+		}
+	}
+}
+
+// the ini settings of Config by key name
+func settingFields() map[string]reflect.StructField {
+	return iniFields(reflect.TypeOf(Config{}))
+}
+
+// the ini settings of a file_target section by key name
+func fileTargetFields() map[string]reflect.StructField {
+	return iniFields(reflect.TypeOf(FileTarget{}))
+}
+
+func iniFields(root reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, opt, _ := strings.Cut(field.Tag.Get("ini"), ",")
+			if opt == "extends" {
+				walk(field.Type)
+			} else if name != "" && name != "-" {
+				fields[name] = field
+			}
+		}
+	}
+	walk(root)
+	return fields
+}
+
+// the known key closest to a misspelt one, if any is close enough
+func closestKey(name string, fields map[string]reflect.StructField) string {
+	var keys []string
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	best, bestDistance := "", len(name)/3+2
+	for _, key := range keys {
+		if d := editDistance(strings.ToLower(name), strings.ToLower(key)); d < bestDistance {
+			best, bestDistance = key, d
+		}
+	}
+	return best
+}
+
+// Levenshtein distance between two strings
+func editDistance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func splitErrors(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"filippo.io/age"
+	"fmt"
+	"github.com/pborman/getopt/v2"
+	"io"
+	"os"
+	"strings"
+	"tnascert-deploy/config"
+)
+
+// the config subcommands, helpers for working with the configuration file
+func runConfigCommand(args []string, configFile string, opts config.Options) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: config encrypt|decrypt [value] | convert [ini_file] | schema")
+	}
+
+	switch args[0] {
+	case "encrypt":
+		set := getopt.New()
+		recipients := set.ListLong("recipient", 'r', "age recipient, an age1... public key or a recipients or identity file; defaults to the identity's public key")
+		set.SetParameters("[value]")
+		set.SetProgram("config encrypt")
+		if err := set.Getopt(append([]string{"config encrypt"}, args[1:]...), nil); err != nil {
+			set.PrintUsage(os.Stderr)
+			return err
+		}
+		value, err := readValue(set.Args())
+		if err != nil {
+			return err
+		}
+		encrypted, err := encryptValue(value, *recipients, opts)
+		if err != nil {
+			return err
+		}
+		fmt.Println(encrypted)
+	case "decrypt":
+		value, err := readValue(args[1:])
+		if err != nil {
+			return err
+		}
+		identities, err := config.LoadIdentities(opts.IdentityFile)
+		if err != nil {
+			return err
+		}
+		plaintext, err := config.DecryptValue(value, identities)
+		if err != nil {
+			return err
+		}
+		fmt.Println(plaintext)
+	case "convert":
+		set := getopt.New()
+		output := set.StringLong("output", 'o', "", "write the YAML to this file instead of stdout")
+		set.SetParameters("[ini_file]")
+		set.SetProgram("config convert")
+		if err := set.Getopt(append([]string{"config convert"}, args[1:]...), nil); err != nil {
+			set.PrintUsage(os.Stderr)
+			return err
+		}
+		if set.NArgs() > 0 {
+			configFile = set.Arg(0)
+		}
+		data, err := config.ConvertToYAML(configFile)
+		if err != nil {
+			return err
+		}
+		if *output == "" {
+			_, err = os.Stdout.Write(data)
+			return err
+		}
+		// the converted file may hold the api key, keep it private
+		return os.WriteFile(*output, data, 0o600)
+	case "schema":
+		data, err := config.Schema()
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	default:
+		return fmt.Errorf("unknown config command %s", args[0])
+	}
+	return nil
+}
+
+func encryptValue(value string, recipientArgs []string, opts config.Options) (string, error) {
+	var recipients []age.Recipient
+	var err error
+
+	if len(recipientArgs) > 0 {
+		recipients, err = config.ParseRecipients(recipientArgs)
+	} else {
+		// encrypt to the identity used to decrypt the config
+		var identities []age.Identity
+		if identities, err = config.LoadIdentities(opts.IdentityFile); err == nil {
+			for _, id := range identities {
+				if x, ok := id.(*age.X25519Identity); ok {
+					recipients = append(recipients, x.Recipient())
+				}
+			}
+			if len(recipients) == 0 {
+				err = fmt.Errorf("the identity file holds no X25519 identities, use --recipient")
+			}
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return config.EncryptValue(value, recipients)
+}
+
+// the value to encrypt or decrypt is the argument or is read from stdin, so
+// that secrets need not appear in the shell history
+func readValue(args []string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package deploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/truenas/api_client_golang/truenas_api"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"tnascert-deploy/config"
+)
+
+// the outcome of adding the certificate to an app
+const (
+	AppUpdated   = "updated"
+	AppUnchanged = "unchanged"
+	AppSkipped   = "skipped"
+	AppLeftAlone = "left alone"
+	AppStopped   = "stopped"
+	AppFailed    = "failed"
+)
+
+// AppResult is the outcome of adding the certificate to one app
+type AppResult struct {
+	Name   string
+	Status string
+	Err    error
+}
+
+// serialClient sends one call at a time so that apps can be updated in
+// parallel, the websocket connection takes a single writer. Only the calls are
+// serialized, the jobs they start run and are monitored concurrently.
+type serialClient struct {
+	Client
+	mu sync.Mutex
+}
+
+func (c *serialClient) Call(method string, timeout int64, params interface{}) (json.RawMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Client.Call(method, timeout, params)
+}
+
+func (c *serialClient) CallWithJob(method string, params interface{}, callback func(progress float64, state string, desc string)) (*truenas_api.Job, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Client.CallWithJob(method, params, callback)
+}
+
+// select the apps matched by the apps, app_name and exclude_apps patterns,
+// warning about any pattern that matches no app
+func selectApps(cfg *config.Config, apps []map[string]interface{}) []map[string]interface{} {
+	var names []string
+	for _, app := range apps {
+		if name, ok := app["name"].(string); ok {
+			names = append(names, name)
+		}
+	}
+	for _, pattern := range cfg.AppPatterns() {
+		if !matchesAny(pattern, names) {
+			log.Printf("Warning: the app pattern %s matches no app", pattern)
+		}
+	}
+	for _, pattern := range cfg.ExcludeApps {
+		if !matchesAny(pattern, names) {
+			log.Printf("Warning: the exclude_apps pattern %s matches no app", pattern)
+		}
+	}
+
+	var selected []map[string]interface{}
+	for _, app := range apps {
+		if name, ok := app["name"].(string); ok && cfg.SelectsApp(name) {
+			selected = append(selected, app)
+		}
+	}
+	return selected
+}
+
+func matchesAny(pattern string, names []string) bool {
+	for _, name := range names {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// the path in the values of an app of its certificate id, ok is false when
+// the app has no certificate setting. Without cert_field only apps with
+// ix_certificates are used, with cert_field the path's parent must exist.
+func appCertificateField(cfg *config.Config, app *InventoryApp) ([]string, bool, error) {
+	if app.Err != nil {
+		return nil, false, app.Err
+	}
+	field, configured := cfg.CertField(app.Name())
+	path := strings.Split(field, ".")
+	if !configured {
+		certificates, _ := app.Values["ix_certificates"].(map[string]interface{})
+		return path, len(certificates) != 0, nil
+	}
+	if len(path) > 1 {
+		if _, ok := valueAt(app.Values, path[:len(path)-1]).(map[string]interface{}); !ok {
+			return path, false, nil
+		}
+	}
+	return path, true, nil
+}
+
+// the value at a path of nested maps, nil if there is none
+func valueAt(values map[string]interface{}, path []string) interface{} {
+	var value interface{} = values
+	for _, key := range path {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
+// a copy of values with the value at path replaced, the maps along the path
+// are copied so that their other settings are kept
+func withValueAt(values map[string]interface{}, path []string, value interface{}) map[string]interface{} {
+	update := make(map[string]interface{}, len(values)+1)
+	for k, v := range values {
+		update[k] = v
+	}
+	if len(path) == 1 {
+		update[path[0]] = value
+		return update
+	}
+	child, _ := values[path[0]].(map[string]interface{})
+	update[path[0]] = withValueAt(child, path[1:], value)
+	return update
+}
+
+// the certificate id at path in the app values, -1 if there is none
+func currentCertificateID(values map[string]interface{}, path []string) int64 {
+	switch v := valueAt(values, path).(type) {
+	case float64:
+		return int64(v)
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	}
+	return -1
+}
+
+// reports whether the certificate with the ID was installed for cert_basename,
+// its name is the basename followed by the date and time it was created
+func ownsCertificate(cfg *config.Config, certID int64) bool {
+	owned := regexp.MustCompile("^" + regexp.QuoteMeta(cfg.CertBasename) + `-\d{4}-\d{2}-\d{2}-\d+$`)
+	for name, id := range certsList {
+		if id == certID && owned.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// with app_selection = follow only the apps using one of our certificates are
+// rebound, apps using another certificate or none are left alone
+func followsApp(cfg *config.Config, currentCertID int64) bool {
+	return cfg.AppSelection != config.AppSelectionFollow || ownsCertificate(cfg, currentCertID)
+}
+
+// log the outcome for each app, returning an error naming the apps that failed
+func reportAppResults(cfg *config.Config, results []AppResult) error {
+	var failed []string
+	for _, result := range results {
+		switch {
+		case result.Err != nil:
+			log.Printf("app %s: %s, %v", result.Name, result.Status, result.Err)
+			failed = append(failed, result.Name)
+		case result.Status == AppLeftAlone:
+			log.Printf("app %s: %s, it does not use a %s certificate", result.Name, result.Status, cfg.CertBasename)
+		case result.Status == AppStopped:
+			log.Printf("app %s: %s, not updated as stopped_apps is %s", result.Name, result.Status, cfg.StoppedApps)
+		case result.Status == AppSkipped:
+			// without patterns every app is tried, most do not use a certificate
+			if len(cfg.AppPatterns()) > 0 {
+				log.Printf("app %s: %s, the app has no certificate setting", result.Name, result.Status)
+			}
+		default:
+			log.Printf("app %s: %s", result.Name, result.Status)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("adding the certificate failed for apps: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/*
+ * Bindings are the TrueNAS services a certificate is bound to. Supporting a
+ * new service means writing a Binding and adding it to registeredBindings.
+ */
+
+package deploy
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"slices"
+	"tnascert-deploy/certfile"
+	"tnascert-deploy/config"
+)
+
+// Binding binds the certificate to a TrueNAS service. The state it reads is
+// kept in the inventory, so a Binding itself holds only its settings.
+type Binding interface {
+	Name() string
+	// Role is the TrueNAS role needed to bind the certificate
+	Role() string
+	// RestartsUI reports whether the UI restarts to take the certificate
+	RestartsUI() bool
+	// Current reads the certificate the service uses into the inventory
+	Current(client Client, cfg *config.Config, inv *Inventory) error
+	// NeedsUpdate reports whether the service does not use the certificate yet
+	NeedsUpdate(cfg *config.Config, inv *Inventory, certID int64) bool
+	// Apply binds the certificate to the service
+	Apply(client Client, cfg *config.Config, inv *Inventory, certID int64) error
+	// Verify checks that the service uses the certificate after Apply
+	Verify(client Client, cfg *config.Config, inv *Inventory, certID int64) error
+	// Restore binds the certificate read by Current again
+	Restore(client Client, cfg *config.Config, inv *Inventory) error
+}
+
+// the bindings by their bind name
+var registeredBindings = map[string]Binding{
+	config.BindUI:     &serviceBinding{name: config.BindUI, namespace: "system.general", field: "ui_certificate", role: "SYSTEM_GENERAL_WRITE", restartsUI: true},
+	config.BindFTP:    &serviceBinding{name: config.BindFTP, namespace: "ftp", field: "ssltls_certificate", role: "SHARING_FTP_WRITE"},
+	config.BindApps:   &appsBinding{},
+	config.BindWebDAV: &serviceBinding{name: config.BindWebDAV, namespace: "webdav", field: "certssl", role: "SHARING_WEBDAV_WRITE"},
+	config.BindLDAP:   &serviceBinding{name: config.BindLDAP, namespace: "ldap", field: "certificate", role: "DIRECTORY_SERVICE_WRITE", job: true},
+	config.BindS3:     &serviceBinding{name: config.BindS3, namespace: "s3", field: "certificate", role: "SERVICE_WRITE"},
+	// kmip.update connects to the server with the new certificate before saving
+	// it, the old one is put back even when the server cannot be reached
+	config.BindKMIP: &serviceBinding{name: config.BindKMIP, namespace: "kmip", field: "certificate", caField: "certificate_authority", role: "KMIP_WRITE", job: true,
+		applyArgs: map[string]interface{}{"validate": true}, restoreArgs: map[string]interface{}{"validate": false}, keep: []string{"enabled", "server", "port"}},
+	config.BindSyslog: &syslogBinding{&serviceBinding{name: config.BindSyslog, namespace: "system.advanced", field: "syslog_tls_certificate",
+		caField: "syslog_tls_certificate_authority", role: "SYSTEM_ADVANCED_WRITE", keep: []string{"syslog_transport"}}},
+}
+
+// bundleChecker is a Binding that takes only certificates fit for its use
+type bundleChecker interface {
+	CheckBundle(bundle *certfile.Bundle) error
+}
+
+// check the certificate against the bindings before it is installed
+func checkBundle(inv *Inventory, bundle *certfile.Bundle) error {
+	for _, b := range inv.Bindings {
+		if checker, ok := b.(bundleChecker); ok {
+			if err := checker.CheckBundle(bundle); err != nil {
+				return fmt.Errorf("the %s binding cannot use the certificate, %v", b.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// the bindings of the section in the order they are applied
+func sectionBindings(cfg *config.Config) ([]Binding, error) {
+	var bindings []Binding
+	for _, name := range cfg.Bindings() {
+		b, ok := registeredBindings[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown binding %s", name)
+		}
+		bindings = append(bindings, b)
+	}
+	return bindings, nil
+}
+
+// apply a binding and verify it, restoring the certificate it used when
+// either fails
+func bind(client Client, cfg *config.Config, inv *Inventory, b Binding, certID int64) error {
+	err := b.Apply(client, cfg, inv, certID)
+	if err == nil {
+		err = b.Verify(client, cfg, inv, certID)
+	}
+	if err == nil {
+		return nil
+	}
+	if restoreErr := b.Restore(client, cfg, inv); restoreErr != nil {
+		log.Printf("restoring the %s certificate failed, %v", b.Name(), restoreErr)
+	}
+	return err
+}
+
+// serviceBinding is a service whose <namespace>.config holds the id of its
+// certificate in field, set with <namespace>.update
+type serviceBinding struct {
+	name        string
+	namespace   string
+	field       string
+	caField     string // the setting taking the ca_path certificate authority, if any
+	role        string
+	restartsUI  bool
+	job         bool                   // <namespace>.update is a job
+	applyArgs   map[string]interface{} // more arguments of the update binding the certificate
+	restoreArgs map[string]interface{} // more arguments of the update restoring the certificate
+	keep        []string               // settings the update must leave as they were
+}
+
+func (b *serviceBinding) Name() string {
+	return b.name
+}
+
+func (b *serviceBinding) Role() string {
+	return b.role
+}
+
+func (b *serviceBinding) RestartsUI() bool {
+	return b.restartsUI
+}
+
+func (b *serviceBinding) Current(client Client, cfg *config.Config, inv *Inventory) error {
+	result, err := serviceConfig(client, cfg, b.namespace+".config")
+	if err != nil {
+		return err
+	}
+	inv.Configs[b.name] = result
+	inv.Services[b.name] = certificateID(result[b.field])
+	if b.usesCA(cfg) {
+		return findCA(client, cfg, inv)
+	}
+	return nil
+}
+
+func (b *serviceBinding) NeedsUpdate(cfg *config.Config, inv *Inventory, certID int64) bool {
+	if inv.Services[b.name] != certID {
+		if cfg.Debug {
+			log.Printf("the %s certificate needs update: current ID %d, target ID %d", b.name, inv.Services[b.name], certID)
+		}
+		return true
+	}
+	if b.usesCA(cfg) && (inv.CA <= 0 || certificateID(inv.Configs[b.name][b.caField]) != inv.CA) {
+		if cfg.Debug {
+			log.Printf("the %s certificate authority needs update to %s", b.name, cfg.CaPath)
+		}
+		return true
+	}
+	return false
+}
+
+func (b *serviceBinding) Apply(client Client, cfg *config.Config, inv *Inventory, certID int64) error {
+	args := map[string]interface{}{b.field: certID}
+	if b.usesCA(cfg) {
+		caID, err := importCA(client, cfg, inv)
+		if err != nil {
+			return err
+		}
+		args[b.caField] = caID
+	}
+	for key, value := range b.applyArgs {
+		args[key] = value
+	}
+	if err := b.update(client, cfg, args); err != nil {
+		return err
+	}
+	log.Printf("the %s certificate updated successfully to certificate ID %d", b.name, certID)
+	return nil
+}
+
+func (b *serviceBinding) Verify(client Client, cfg *config.Config, inv *Inventory, certID int64) error {
+	result, err := serviceConfig(client, cfg, b.namespace+".config")
+	if err != nil {
+		return err
+	}
+	if id := certificateID(result[b.field]); id != certID {
+		return fmt.Errorf("the %s certificate is ID %d after the update to ID %d", b.name, id, certID)
+	}
+	if b.usesCA(cfg) {
+		if id := certificateID(result[b.caField]); id != inv.CA {
+			return fmt.Errorf("the %s certificate authority is ID %d after the update to ID %d", b.name, id, inv.CA)
+		}
+	}
+	for _, key := range b.keep {
+		if fmt.Sprint(result[key]) != fmt.Sprint(inv.Configs[b.name][key]) {
+			return fmt.Errorf("the %s %s changed to %v with the certificate", b.name, key, result[key])
+		}
+	}
+	inv.Services[b.name] = certID
+	return nil
+}
+
+func (b *serviceBinding) Restore(client Client, cfg *config.Config, inv *Inventory) error {
+	previous, ok := inv.Configs[b.name]
+	if !ok {
+		return nil
+	}
+	args := map[string]interface{}{b.field: idOrNil(certificateID(previous[b.field]))}
+	if b.caField != "" {
+		args[b.caField] = idOrNil(certificateID(previous[b.caField]))
+	}
+	for key, value := range b.restoreArgs {
+		args[key] = value
+	}
+	if err := b.update(client, cfg, args); err != nil {
+		return err
+	}
+	log.Printf("the %s certificate was restored to certificate ID %d", b.name, certificateID(previous[b.field]))
+	return nil
+}
+
+// whether the ca_path certificate authority is bound too
+func (b *serviceBinding) usesCA(cfg *config.Config) bool {
+	return b.caField != "" && cfg.CaPath != ""
+}
+
+func (b *serviceBinding) update(client Client, cfg *config.Config, args map[string]interface{}) error {
+	method := b.namespace + ".update"
+	params := []interface{}{args}
+	if b.job {
+		return runJob(client, cfg, method, params, "updating the "+b.name+" certificate")
+	}
+	if _, err := client.Call(method, cfg.TimeoutSeconds, params); err != nil {
+		return fmt.Errorf("%s of %s failed, %v", method, b.field, err)
+	}
+	return nil
+}
+
+// a certificate id as an argument, nil for none
+func idOrNil(id int64) interface{} {
+	if id < 0 {
+		return nil
+	}
+	return id
+}
+
+// appsBinding gives the certificate to the apps selected by the section
+type appsBinding struct{}
+
+func (b *appsBinding) Name() string {
+	return config.BindApps
+}
+
+func (b *appsBinding) Role() string {
+	return "APPS_WRITE"
+}
+
+func (b *appsBinding) RestartsUI() bool {
+	return false
+}
+
+func (b *appsBinding) Current(client Client, cfg *config.Config, inv *Inventory) error {
+	apps, err := takeAppInventory(client, cfg)
+	if err != nil {
+		return err
+	}
+	inv.Apps = apps
+	return nil
+}
+
+func (b *appsBinding) NeedsUpdate(cfg *config.Config, inv *Inventory, certID int64) bool {
+	return checkIfAppsNeedCertUpdate(cfg, inv, certID)
+}
+
+func (b *appsBinding) Apply(client Client, cfg *config.Config, inv *Inventory, certID int64) error {
+	return addAsAppCertificateByID(client, cfg, inv, certID)
+}
+
+// each updated app has already been waited for until it runs
+func (b *appsBinding) Verify(client Client, cfg *config.Config, inv *Inventory, certID int64) error {
+	return nil
+}
+
+// each app is updated on its own, an app whose update failed keeps its
+// certificate and one that does not run afterwards is put back on its previous
+// certificate by updateAppCertificate, so there is nothing left to restore
+func (b *appsBinding) Restore(client Client, cfg *config.Config, inv *Inventory) error {
+	return nil
+}
+
+// syslogBinding is the client certificate remote syslog presents over TLS,
+// changing it needs no restart
+type syslogBinding struct {
+	*serviceBinding
+}
+
+// a client certificate must allow client authentication, a server
+// certificate is refused by the syslog server
+func (b *syslogBinding) CheckBundle(bundle *certfile.Bundle) error {
+	usages, err := bundle.ExtKeyUsage()
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(usages, x509.ExtKeyUsageClientAuth) && !slices.Contains(usages, x509.ExtKeyUsageAny) {
+		return fmt.Errorf("it does not have the clientAuth extended key usage")
+	}
+	return nil
+}
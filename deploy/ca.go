@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/*
+ * The ca_path certificate authority, imported once and bound by the
+ * bindings that take a certificate authority.
+ */
+
+package deploy
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"tnascert-deploy/config"
+)
+
+type CAResponse struct {
+	JsonRPC string                 `json:"jsonrpc"`
+	ID      int                    `json:"id"`
+	Result  map[string]interface{} `json:"result"`
+}
+
+// read ca_path, returning its first certificate pem encoded and the name it
+// is imported as, which follows from its content so a run finds the import
+// of an earlier one
+func readCA(cfg *config.Config) (string, string, error) {
+	data, err := os.ReadFile(cfg.CaPath)
+	if err != nil {
+		return "", "", fmt.Errorf("could not read ca_path, %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", "", fmt.Errorf("no certificate found in ca_path %s", cfg.CaPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", "", fmt.Errorf("could not parse ca_path %s, %v", cfg.CaPath, err)
+	}
+	if !cert.IsCA {
+		return "", "", fmt.Errorf("ca_path %s is not a CA certificate", cfg.CaPath)
+	}
+	sum := sha256.Sum256(cert.Raw)
+	return string(pem.EncodeToMemory(block)), "tnascert-ca-" + hex.EncodeToString(sum[:6]), nil
+}
+
+// look up the certificate authority of ca_path, leaving inv.CA 0 when it
+// has not been imported
+func findCA(client Client, cfg *config.Config, inv *Inventory) error {
+	if inv.CA > 0 {
+		return nil
+	}
+	_, name, err := readCA(cfg)
+	if err != nil {
+		return err
+	}
+	filters := []interface{}{[]interface{}{"name", "=", name}}
+	resp, err := client.Call("certificateauthority.query", cfg.TimeoutSeconds, []interface{}{filters})
+	if err != nil {
+		return fmt.Errorf("certificateauthority.query failed, %v", err)
+	}
+	var response CertificateListResponse
+	if err = json.Unmarshal(resp, &response); err != nil {
+		return fmt.Errorf("could not parse the certificate authority list, %v", err)
+	}
+	if len(response.Result) > 0 {
+		inv.CA = certificateID(response.Result[0]["id"])
+	}
+	return nil
+}
+
+// the id of the certificate authority of ca_path, importing it when needed
+func importCA(client Client, cfg *config.Config, inv *Inventory) (int64, error) {
+	if err := findCA(client, cfg, inv); err != nil {
+		return -1, err
+	}
+	if inv.CA > 0 {
+		return inv.CA, nil
+	}
+	certificate, name, err := readCA(cfg)
+	if err != nil {
+		return -1, err
+	}
+	args := map[string]interface{}{
+		"name":        name,
+		"create_type": "CA_CREATE_IMPORTED",
+		"certificate": certificate,
+	}
+	resp, err := client.Call("certificateauthority.create", cfg.TimeoutSeconds, []interface{}{args})
+	if err != nil {
+		return -1, fmt.Errorf("importing ca_path failed, %v", err)
+	}
+	var response CAResponse
+	if err = json.Unmarshal(resp, &response); err != nil {
+		return -1, fmt.Errorf("could not parse the certificateauthority.create response, %v", err)
+	}
+	if inv.CA = certificateID(response.Result["id"]); inv.CA <= 0 {
+		return -1, fmt.Errorf("importing ca_path failed, no id in the response")
+	}
+	log.Printf("imported %s as certificate authority %s (ID: %d)", cfg.CaPath, name, inv.CA)
+	return inv.CA, nil
+}
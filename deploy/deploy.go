@@ -42,11 +42,12 @@ import (
 	"fmt"
 	"github.com/truenas/api_client_golang/truenas_api"
 	"log"
-	"os"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"tnascert-deploy/certfile"
 	"tnascert-deploy/config"
 )
 
@@ -59,6 +60,13 @@ type AppConfigResponse struct {
 	} `json:"result"`
 }
 
+// the values of an app, used where the certificate id may be anywhere in them
+type AppValuesResponse struct {
+	JsonRPC string                 `json:"jsonrpc"`
+	ID      int                    `json:"id"`
+	Result  map[string]interface{} `json:"result"`
+}
+
 type AppListQueryResponse struct {
 	JsonRPC string                   `json:"jsonrpc"`
 	ID      int                      `json:"id"`
@@ -83,173 +91,166 @@ type Client interface {
 	SubscribeToJobs() error
 }
 
-func addAsAppCertificateByID(client Client, cfg *config.Config, certID int64) error {
-	args := []interface{}{}
-	resp, err := client.Call("app.query", cfg.TimeoutSeconds, args)
+// app jobs pull images and recreate containers, they are given at least
+// minAppJobTimeout seconds whatever timeoutSeconds is
+const minAppJobTimeout = 60
+
+// start a job and wait for it to finish
+func runJob(client Client, cfg *config.Config, method string, params interface{}, what string) error {
+	job, err := client.CallWithJob(method, params, func(progress float64, state string, desc string) {
+		log.Printf("Job Progress: %.2f%%, State: %s, Description: %s", progress, state, desc)
+	})
 	if err != nil {
-		return fmt.Errorf("app query failed, %v", err)
+		return fmt.Errorf("%s failed, %v", what, err)
 	}
-
 	if cfg.Debug {
-		log.Printf("app query response: %v", string(resp))
-	}
-	var response AppListQueryResponse
-	err = json.Unmarshal(resp, &response)
-	if err != nil {
-		return err
+		log.Printf("started the %s job with ID: %d", method, job.ID)
 	}
 
-	for _, app := range response.Result {
-		// If an app name is specified, only apply to that app
-		if cfg.AppName != "" && app["name"].(string) != cfg.AppName {
+	seconds := cfg.TimeoutSeconds
+	if strings.HasPrefix(method, "app.") {
+		seconds = max(seconds, minAppJobTimeout)
+	}
+	timeout := time.After(time.Duration(seconds) * time.Second)
+	for !job.Finished {
+		select {
+		case <-job.ProgressCh:
+		case err := <-job.DoneCh:
+			if err != "" {
+				return fmt.Errorf("%s failed, %v", what, err)
+			}
+			return nil
+		case <-timeout:
+			return fmt.Errorf("%s timed out after %d seconds", what, seconds)
+		case <-time.After(100 * time.Millisecond):
 			continue
 		}
+	}
+	return nil
+}
 
-		var response AppConfigResponse
-		args := []interface{}{app["id"]}
-		appConfig, err := client.Call("app.config", cfg.TimeoutSeconds, args)
-		if err != nil {
-			return fmt.Errorf("app config query failed, %v", err)
-		}
-		err = json.Unmarshal(appConfig, &response)
-		if err != nil {
-			return fmt.Errorf("app config query failed, %v", err)
-		}
-		if len(response.Result.IxCertificates) != 0 {
-			
-			// Check if the app already has the correct certificate
-			currentCertID := int64(-1)
-			if response.Result.Network != nil {
-				if certIDVal, exists := response.Result.Network["certificate_id"]; exists {
-					switch v := certIDVal.(type) {
-					case float64:
-						currentCertID = int64(v)
-					case int64:
-						currentCertID = v
-					case int:
-						currentCertID = int64(v)
-					}
-				}
-			}
-			
-			if currentCertID == certID {
-				if cfg.Debug {
-					log.Printf("App %s already has the correct certificate (ID: %d), skipping update", app["name"], certID)
-				}
-				continue
-			}
-			
-			var params []interface{}
-			
-			if cfg.Debug {
-				log.Printf("Current app config for %s: %+v", app["name"], response.Result)
-			}
-			
-			// Get the current network configuration and preserve it
-			currentConfig := make(map[string]interface{})
-			if response.Result.Network != nil {
-				// Copy existing network config
-				for k, v := range response.Result.Network {
-					currentConfig[k] = v
-				}
-			}
-			
-			// Update only the certificate_id while preserving other settings
-			currentConfig["certificate_id"] = certID
-			
-			if cfg.Debug {
-				log.Printf("Updated network config for %s: %+v", app["name"], currentConfig)
-			}
-			
-			m := map[string]map[string]interface{}{
-				"network": currentConfig,
-			}
-			n := map[string]interface{}{
-				"values": m,
-			}
-			params = append(params, app["name"])
-			params = append(params, n)
+func addAsAppCertificateByID(client Client, cfg *config.Config, inv *Inventory, certID int64) error {
+	// update each selected app on its own so that one failure does not stop the
+	// others, up to app_parallel at a time
+	results := make([]AppResult, len(inv.Apps))
+	client = &serialClient{Client: client}
+	limit := make(chan struct{}, max(cfg.AppParallel, 1))
+	var wg sync.WaitGroup
+	for i, app := range inv.Apps {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(i int, app *InventoryApp) {
+			defer wg.Done()
+			defer func() { <-limit }()
+			status, err := updateAppCertificate(client, cfg, app, certID)
+			results[i] = AppResult{Name: app.Name(), Status: status, Err: err}
+		}(i, app)
+	}
+	wg.Wait()
+	return reportAppResults(cfg, results)
+}
 
-			job, err := client.CallWithJob("app.update", params, func(progress float64, state string, desc string) {
-				log.Printf("Job Progress: %.2f%%, State: %s, Description: %s", progress, state, desc)
-			})
-			if err != nil {
-				return fmt.Errorf("failed to update app certificate, %v", err)
-			}
-			log.Printf("started the app update job with ID: %d", job.ID)
+// point an app's certificate setting at the certificate
+func updateAppCertificate(client Client, cfg *config.Config, inventoryApp *InventoryApp, certID int64) (string, error) {
+	app, values := inventoryApp.App, inventoryApp.Values
+	field, ok, err := appCertificateField(cfg, inventoryApp)
+	if err != nil {
+		return AppFailed, err
+	}
+	if !ok {
+		return AppSkipped, nil
+	}
 
-			// Monitor the progress of the job with timeout
-			jobCompleted := false
-			timeout := time.After(time.Duration(cfg.TimeoutSeconds) * time.Second)
-			
-			for !job.Finished && !jobCompleted {
-				select {
-				case progress := <-job.ProgressCh:
-					log.Printf("Job progress: %.2f%%", progress)
-				case err := <-job.DoneCh:
-					jobCompleted = true
-					if err != "" {
-						return fmt.Errorf("job failed: %v", err)
-					} else {
-						log.Println("Job completed successfully!")
-					}
-				case <-timeout:
-					return fmt.Errorf("job timed out after %d seconds", cfg.TimeoutSeconds)
-				case <-time.After(100 * time.Millisecond):
-					// Periodic check to prevent deadlock if channels are not working properly
-					continue
-				}
-			}
+	// Check if the app already has the correct certificate
+	currentCertID := currentCertificateID(values, field)
+	if !followsApp(cfg, currentCertID) {
+		return AppLeftAlone, nil
+	}
 
-			log.Printf("updated the certificate for app: %s to use certificate ID: %d", app["name"], certID)
+	if currentCertID == certID {
+		if cfg.Debug {
+			log.Printf("App %s already has the correct certificate (ID: %d), skipping update", app["name"], certID)
 		}
+		return AppUnchanged, nil
 	}
-	return nil
-}
 
-func addAsFTPCertificate(client Client, cfg *config.Config) error {
-	var certName = cfg.CertName()
-	ID, ok := certsList[certName]
-	if !ok {
-		return fmt.Errorf("certificate %s not found in the certificates list", certName)
+	// a stopped app is handled according to stopped_apps
+	name, _ := app["name"].(string)
+	stopped := app["state"] == AppStateStopped
+	if stopped && cfg.StoppedApps == config.StoppedAppsSkip {
+		return AppStopped, nil
 	}
-	pmap := map[string]int64{
-		"ssltls_certificate": ID,
+
+	if cfg.Debug {
+		log.Printf("Current app config for %s: %+v", app["name"], values)
 	}
-	args := []interface{}{pmap}
-	_, err := client.Call("ftp.update", cfg.TimeoutSeconds, args)
-	if err != nil {
-		return fmt.Errorf("updating the FTP service certificate failed, %v", err)
-	} else {
-		log.Printf("the FTP service certificate updated successfully to %s", certName)
+	if err = setAppCertificate(client, cfg, inventoryApp, field, certID); err != nil {
+		return AppFailed, err
 	}
+	log.Printf("updated the certificate for app: %s to use certificate ID: %d", app["name"], certID)
 
-	return nil
+	// make sure the app runs with the new certificate, an app that does not is
+	// put back on its previous certificate
+	if stopped {
+		if cfg.StoppedApps != config.StoppedAppsStart {
+			return AppUpdated, nil
+		}
+		if err = startApp(client, cfg, name); err != nil {
+			return AppFailed, restoreAppCertificate(client, cfg, inventoryApp, field, currentCertID, err)
+		}
+	}
+	if err = waitForApp(client, cfg, name); err != nil {
+		return AppFailed, restoreAppCertificate(client, cfg, inventoryApp, field, currentCertID, err)
+	}
+	return AppUpdated, nil
 }
 
-func addAsUICertificateByID(client Client, cfg *config.Config, certID int64) (bool, error) {
-	pmap := map[string]int64{
-		"ui_certificate": certID,
+// point the certificate setting of an app at a certificate, none when certID
+// is -1, and wait for the app.update job
+func setAppCertificate(client Client, cfg *config.Config, inventoryApp *InventoryApp, field []string, certID int64) error {
+	app := inventoryApp.App
+	var id interface{} = certID
+	if certID < 0 {
+		id = nil
+	}
+
+	// Update only the certificate id, preserving the other settings along its path
+	updated := withValueAt(inventoryApp.Values, field, id)
+	m := map[string]interface{}{
+		field[0]: updated[field[0]],
+	}
+
+	if cfg.Debug {
+		log.Printf("Updated %s config for %s: %+v", field[0], app["name"], m[field[0]])
 	}
-	args := []interface{}{pmap}
-	_, err := client.Call("system.general.update", cfg.TimeoutSeconds, args)
+
+	params := []interface{}{app["name"], map[string]interface{}{"values": m}}
+	err := runJob(client, cfg, "app.update", params, fmt.Sprintf("updating the certificate of app %s", app["name"]))
 	if err != nil {
-		return false, fmt.Errorf("system.general.update of ui_certificate failed, %v", err)
+		return err
 	}
-	return true, nil
+	inventoryApp.Values = updated
+	return nil
 }
 
-func addAsFTPCertificateByID(client Client, cfg *config.Config, certID int64) error {
-	// Implementation for FTP certificate if needed
-	// For now, just return nil as it's not commonly used
-	return nil
+// put an app that does not run after its update back on its previous
+// certificate, returning the error that made it fail
+func restoreAppCertificate(client Client, cfg *config.Config, inventoryApp *InventoryApp, field []string, previous int64, cause error) error {
+	if err := setAppCertificate(client, cfg, inventoryApp, field, previous); err != nil {
+		return fmt.Errorf("%v, restoring its previous certificate failed, %v", cause, err)
+	}
+	log.Printf("app %s was restored to certificate ID %d", inventoryApp.Name(), previous)
+	return cause
 }
 
 // login with an API key
 func clientLogin(client Client, cfg *config.Config) error {
+	if cfg.Username != "" {
+		return passwordLogin(client, cfg)
+	}
 	username, password := "", ""
 	if cfg.Api_key == "" {
-		return fmt.Errorf("login failure, o api key")
+		return fmt.Errorf("login failure, no api key")
 	}
 	apikey := cfg.Api_key
 	err := client.Login(username, password, apikey)
@@ -261,24 +262,19 @@ func clientLogin(client Client, cfg *config.Config) error {
 }
 
 // deploy the certificate in TrueNAS
-func createCertificate(client Client, cfg *config.Config) error {
+func createCertificate(client Client, cfg *config.Config, bundle *certfile.Bundle) error {
 	var certName = cfg.CertName()
-	// read in the certificate data
-	certPem, err := os.ReadFile(cfg.FullChainPath)
-	if err != nil {
-		return fmt.Errorf("could not load the pem encoded certificate, %v", err)
-	}
-	// read in the private key data
-	keyPem, err := os.ReadFile(cfg.Private_key_path)
-	if err != nil {
-		return fmt.Errorf("could not load the pem encoded private key, %v", err)
+	// make sure the files on disk still hold the bytes that were validated
+	if err := bundle.CheckUnchanged(); err != nil {
+		return fmt.Errorf("refusing to upload the certificate, %v", err)
 	}
+	certPem, keyPem := bundle.Certificate, bundle.PrivateKey
 
 	if cfg.Debug {
 		log.Printf("create the certificate: %s", certName)
 	}
 
-	if err = client.SubscribeToJobs(); err != nil {
+	if err := client.SubscribeToJobs(); err != nil {
 		return fmt.Errorf("unable to subscribe to job notifications, %v", err)
 	}
 
@@ -382,7 +378,6 @@ func loadCertificateList(client Client, cfg *config.Config) error {
 }
 
 func loadCertificateListWithCheck(client Client, cfg *config.Config, skipNewCertCheck bool, expectedCertName string) error {
-	var inlist = false
 	var certName = cfg.CertName()
 	if expectedCertName != "" {
 		certName = expectedCertName
@@ -402,10 +397,17 @@ func loadCertificateListWithCheck(client Client, cfg *config.Config, skipNewCert
 	if err != nil {
 		return err
 	}
+	return addToCertsList(cfg, response.Result, skipNewCertCheck, certName)
+}
+
+// add the certificates matching the basename to the local certificate list,
+// checking for certName unless skipNewCertCheck
+func addToCertsList(cfg *config.Config, certs []map[string]interface{}, skipNewCertCheck bool, certName string) error {
+	var inlist = false
 
 	// range over the list obtained from the server and build up a local
 	// certificate list
-	for _, v := range response.Result {
+	for _, v := range certs {
 		var cert = v
 		_, ok := certsList[cert["name"].(string)]
 		// add certificate to the certificate list if not already there
@@ -444,67 +446,9 @@ func loadCertificateListWithCheck(client Client, cfg *config.Config, skipNewCert
 	return nil
 }
 
-// checkForRecentCertificate checks if there's already a recent certificate for the same base name
-// A certificate is considered recent if it was created within the last 30 minutes
-func checkForRecentCertificate(cfg *config.Config) bool {
-	thirtyMinutesAgo := time.Now().Add(-30 * time.Minute)
-	
-	for certName := range certsList {
-		if strings.HasPrefix(certName, cfg.CertBasename) {
-			// Extract timestamp from certificate name (format: basename-YYYY-MM-DD-unixtimestamp)
-			parts := strings.Split(certName, "-")
-			if len(parts) >= 4 {
-				// Get the last part which should be the unix timestamp
-				timestampStr := parts[len(parts)-1]
-				// Parse as unix timestamp (seconds since epoch)
-				if timestamp, err := strconv.ParseInt(timestampStr, 10, 64); err == nil {
-					certTime := time.Unix(timestamp, 0)
-					if certTime.After(thirtyMinutesAgo) {
-						if cfg.Debug {
-							log.Printf("found recent certificate %s created at %v (within 30 minutes)", certName, certTime)
-						}
-						return true
-					}
-				}
-			}
-		}
-	}
-	return false
-}
-
-// isAppUsingRecentCert checks if the given certificate ID corresponds to a recent certificate for the same base name
-func isAppUsingRecentCert(certID int64, cfg *config.Config) bool {
-	if certID <= 0 {
-		return false
-	}
-	
-	thirtyMinutesAgo := time.Now().Add(-30 * time.Minute)
-	
-	// Find the certificate name for this ID
-	for certName, id := range certsList {
-		if id == certID && strings.HasPrefix(certName, cfg.CertBasename) {
-			// Extract timestamp from certificate name
-			parts := strings.Split(certName, "-")
-			if len(parts) >= 4 {
-				timestampStr := parts[len(parts)-1]
-				if timestamp, err := strconv.ParseInt(timestampStr, 10, 64); err == nil {
-					certTime := time.Unix(timestamp, 0)
-					if certTime.After(thirtyMinutesAgo) {
-						if cfg.Debug {
-							log.Printf("App is using recent certificate %s (ID: %d) created at %v", certName, certID, certTime)
-						}
-						return true
-					}
-				}
-			}
-		}
-	}
-	return false
-}
-
 // checkIfUpdateNeeded determines if we need to create/update certificates or if everything is already current
 // Returns (needsUpdate, existingCertID)
-func checkIfUpdateNeeded(client Client, cfg *config.Config) (bool, int64) {
+func checkIfUpdateNeeded(cfg *config.Config, inv *Inventory) (bool, int64) {
 	// First check if there are any recent certificates for this base name
 	recentCertID := findRecentCertificate(cfg)
 	if recentCertID <= 0 {
@@ -514,13 +458,9 @@ func checkIfUpdateNeeded(client Client, cfg *config.Config) (bool, int64) {
 			if cfg.Debug {
 				log.Printf("Found valid non-expiring certificate (ID: %d), checking if apps need update", validCertID)
 			}
-			// Check if apps are already using this certificate
-			if cfg.AddAsAppCertificate {
-				appsNeedUpdate := checkIfAppsNeedCertUpdate(client, cfg, validCertID)
-				if !appsNeedUpdate {
-					return false, validCertID // Certificate is valid and apps are using it
-				}
-				return true, validCertID // Use existing cert but update apps
+			// Check if the services are already using this certificate
+			if bindingsNeedUpdate(cfg, inv, validCertID) {
+				return true, validCertID // Use existing cert but update the services
 			}
 			return false, validCertID // Certificate is valid, no updates needed
 		}
@@ -528,18 +468,9 @@ func checkIfUpdateNeeded(client Client, cfg *config.Config) (bool, int64) {
 		return true, 0
 	}
 
-	// Check if apps are already using the recent certificate
-	if cfg.AddAsAppCertificate {
-		appsNeedUpdate := checkIfAppsNeedCertUpdate(client, cfg, recentCertID)
-		if appsNeedUpdate {
-			return true, recentCertID // Use existing cert but update apps
-		}
-	}
-
-	// Check UI certificate if needed
-	if cfg.AddAsUiCertificate {
-		// Could add UI certificate check here if needed
-		// For now, assume UI updates are less disruptive
+	// Check if the services are already using the recent certificate
+	if bindingsNeedUpdate(cfg, inv, recentCertID) {
+		return true, recentCertID // Use existing cert but update the services
 	}
 
 	return false, recentCertID // Everything is up to date
@@ -623,60 +554,35 @@ func findValidCertificate(cfg *config.Config) int64 {
 	return 0
 }
 
-// checkIfAppsNeedCertUpdate checks if any apps need certificate updates
-func checkIfAppsNeedCertUpdate(client Client, cfg *config.Config, targetCertID int64) bool {
-	args := []interface{}{}
-	resp, err := client.Call("app.query", cfg.TimeoutSeconds, args)
-	if err != nil {
-		log.Printf("Warning: failed to query apps: %v", err)
-		return true // Assume update needed if we can't check
-	}
-
-	var response AppListQueryResponse
-	err = json.Unmarshal(resp, &response)
-	if err != nil {
-		log.Printf("Warning: failed to parse apps response: %v", err)
-		return true
-	}
-
-	for _, app := range response.Result {
-		// If an app name is specified, only check that app
-		if cfg.AppName != "" && app["name"].(string) != cfg.AppName {
-			continue
+// bindingsNeedUpdate reports whether a service the section binds does not use the certificate yet
+func bindingsNeedUpdate(cfg *config.Config, inv *Inventory, certID int64) bool {
+	for _, b := range inv.Bindings {
+		if b.NeedsUpdate(cfg, inv, certID) {
+			return true
 		}
+	}
+	return false
+}
 
-		// Get app config to check current certificate
-		var appResponse AppConfigResponse
-		args := []interface{}{app["id"]}
-		appConfig, err := client.Call("app.config", cfg.TimeoutSeconds, args)
+// checkIfAppsNeedCertUpdate checks if any apps need certificate updates
+func checkIfAppsNeedCertUpdate(cfg *config.Config, inv *Inventory, targetCertID int64) bool {
+	for _, app := range inv.Apps {
+		field, ok, err := appCertificateField(cfg, app)
 		if err != nil {
 			continue // Skip this app if we can't get config
 		}
-		err = json.Unmarshal(appConfig, &appResponse)
-		if err != nil {
-			continue
-		}
 
-		if len(appResponse.Result.IxCertificates) != 0 {
+		if ok {
 			// Check current certificate ID
-			currentCertID := int64(-1)
-			if appResponse.Result.Network != nil {
-				if certIDVal, exists := appResponse.Result.Network["certificate_id"]; exists {
-					switch v := certIDVal.(type) {
-					case float64:
-						currentCertID = int64(v)
-					case int64:
-						currentCertID = v
-					case int:
-						currentCertID = int64(v)
-					}
-				}
+			currentCertID := currentCertificateID(app.Values, field)
+			if !followsApp(cfg, currentCertID) {
+				continue
 			}
 
 			if currentCertID != targetCertID {
 				if cfg.Debug {
-					log.Printf("App %s needs certificate update: current ID %d, target ID %d", 
-						app["name"], currentCertID, targetCertID)
+					log.Printf("App %s needs certificate update: current ID %d, target ID %d",
+						app.Name(), currentCertID, targetCertID)
 				}
 				return true // At least one app needs update
 			}
@@ -686,7 +592,7 @@ func checkIfAppsNeedCertUpdate(client Client, cfg *config.Config, targetCertID i
 	return false // All apps are already using the target certificate
 }
 
-func InstallCertificate(client Client, cfg *config.Config) error {
+func InstallCertificate(client Client, cfg *config.Config, bundle *certfile.Bundle) error {
 	var certName string = cfg.CertName()
 	var activated = false
 
@@ -695,14 +601,42 @@ func InstallCertificate(client Client, cfg *config.Config) error {
 	}
 	log.Printf("installing certificate: %s", certName)
 
+	// start from an empty certificate list, a hook run may deploy several sections
+	certsList = map[string]int64{}
+
 	// login
 	err := clientLogin(client, cfg)
 	if err != nil {
 		return err
 	}
 
+	// fail before any change when the credentials lack a needed role
+	user, privileges, err := CheckPrivileges(client, cfg)
+	if err != nil {
+		log.Printf("could not check the privileges, continuing, %v", err)
+	} else {
+		if err = MissingPrivileges(privileges); err != nil {
+			return fmt.Errorf("%s: %v", user, err)
+		}
+		if cfg.Debug {
+			log.Printf("%s holds the privileges needed for the configured actions", user)
+		}
+	}
+
+	// take one snapshot of the certificates and the services using them, the
+	// decisions below are made from it
+	inv, err := takeInventory(client, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to take the inventory: %v", err)
+	}
+
+	// refuse a certificate a binding cannot use before anything changes
+	if err = checkBundle(inv, bundle); err != nil {
+		return err
+	}
+
 	// First load existing certificates to check what's already deployed
-	err = loadCertificateListWithCheck(client, cfg, true, "")
+	err = addToCertsList(cfg, inv.Certificates, true, "")
 	if err != nil {
 		return fmt.Errorf("failed to load certificate list: %v", err)
 	}
@@ -711,14 +645,14 @@ func InstallCertificate(client Client, cfg *config.Config) error {
 	if cfg.Debug {
 		log.Printf("Checking if update is needed for %s...", cfg.CertBasename)
 	}
-	needsUpdate, existingCertID := checkIfUpdateNeeded(client, cfg)
+	needsUpdate, existingCertID := checkIfUpdateNeeded(cfg, inv)
 	if cfg.Debug {
 		log.Printf("Update check result: needsUpdate=%t, existingCertID=%d", needsUpdate, existingCertID)
 	}
 	
 	if !needsUpdate {
 		log.Printf("Certificate and app configuration are already up to date for %s, no action needed", cfg.CertBasename)
-		return nil
+		return deployFileTargets(client, cfg, bundle)
 	}
 
 	var certID int64
@@ -729,7 +663,7 @@ func InstallCertificate(client Client, cfg *config.Config) error {
 	} else {
 		// Create new certificate only if none exists or all are old
 		log.Printf("Creating new certificate for %s", cfg.CertBasename)
-		err = createCertificate(client, cfg)
+		err = createCertificate(client, cfg, bundle)
 		if err != nil {
 			return err
 		}
@@ -747,26 +681,16 @@ func InstallCertificate(client Client, cfg *config.Config) error {
 		}
 	}
 
-	// Now apply certificates where needed
-	if cfg.AddAsUiCertificate {
-		activated, err = addAsUICertificateByID(client, cfg, certID)
-		if err != nil {
-			return err
-		}
-	}
-
-	if cfg.AddAsFTPCertificate {
-		err := addAsFTPCertificateByID(client, cfg, certID)
-		if err != nil {
-			return err
+	// Now bind the certificate where needed
+	for _, b := range inv.Bindings {
+		if !b.NeedsUpdate(cfg, inv, certID) {
+			log.Printf("the %s binding already uses certificate ID %d", b.Name(), certID)
+			continue
 		}
-	}
-
-	if cfg.AddAsAppCertificate {
-		err := addAsAppCertificateByID(client, cfg, certID)
-		if err != nil {
+		if err = bind(client, cfg, inv, b, certID); err != nil {
 			return err
 		}
+		activated = activated || b.RestartsUI()
 	}
 
 	if activated {
@@ -789,5 +713,5 @@ func InstallCertificate(client Client, cfg *config.Config) error {
 		log.Printf("%s was not activated as the UI certificate therefore no certificates will be deleted", certName)
 	}
 
-	return nil
+	return deployFileTargets(client, cfg, bundle)
 }
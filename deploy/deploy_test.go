@@ -18,8 +18,25 @@
 package deploy
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+	"tnascert-deploy/certfile"
 	"tnascert-deploy/config"
 )
 
@@ -45,7 +62,12 @@ func TestDeployPkg(t *testing.T) {
 		t.Errorf("client login failed with error: %v", err)
 	}
 
-	err = createCertificate(client, cfg)
+	bundle, err := certfile.Load(cfg.FullChainPath, cfg.Private_key_path, certfile.Options{})
+	if err != nil {
+		t.Fatalf("loading the certificate key pair failed with error: %v", err)
+	}
+
+	err = createCertificate(client, cfg, bundle)
 	if err != nil {
 		t.Errorf("create certificate failed with error: %v", err)
 	}
@@ -55,19 +77,20 @@ func TestDeployPkg(t *testing.T) {
 		t.Errorf("load certificate list failed with error: %v", err)
 	}
 
-	err = addAsFTPCertificate(client, cfg)
+	certID := certsList[certName]
+	err = bind(client, cfg, inventory(t, client, cfg), registeredBindings[config.BindFTP], certID)
 	if err != nil {
-		t.Errorf("addAsFTPCertificate failed with error: %v", err)
+		t.Errorf("binding the FTP certificate failed with error: %v", err)
 	}
 
-	result, err := addAsUICertificate(client, cfg)
-	if err != nil && result != true {
-		t.Errorf("addAsUICertificate failed with error: %v", err)
+	err = bind(client, cfg, inventory(t, client, cfg), registeredBindings[config.BindUI], certID)
+	if err != nil {
+		t.Errorf("binding the UI certificate failed with error: %v", err)
 	}
 
-	err = addAsAppCertificate(client, cfg)
+	err = addAsAppCertificateByID(client, cfg, inventory(t, client, cfg), certID)
 	if err != nil {
-		t.Errorf("addAsAppCertificate failed with error: %v", err)
+		t.Errorf("addAsAppCertificateByID failed with error: %v", err)
 	}
 
 	err = deleteCertificates(client, cfg)
@@ -75,8 +98,640 @@ func TestDeployPkg(t *testing.T) {
 		t.Errorf("delete certificates failed with error: %v", err)
 	}
 
-	err = InstallCertificate(client, cfg)
+	err = InstallCertificate(client, cfg, bundle)
 	if err != nil {
 		t.Errorf("install certificate failed with error: %v", err)
 	}
 }
+
+// take the inventory of the mock client
+func inventory(t *testing.T, client Client, cfg *config.Config) *Inventory {
+	inv, err := takeInventory(client, cfg)
+	if err != nil {
+		t.Fatalf("takeInventory failed with error: %v", err)
+	}
+	return inv
+}
+
+func TestAppSelection(t *testing.T) {
+	cfg := &config.Config{ConnectHost: "nas01.mydomain.com", Port: 443, Protocol: "wss", TimeoutSeconds: 10, AddAsAppCertificate: true}
+	cfg.Apps = []string{"nextcloud", "minio-*", "jellyfin"}
+	cfg.ExcludeApps = []string{"*-test"}
+	client, _ := NewClient(cfg.ServerURL(), false)
+	client.SetConfig(cfg)
+	client.apps = []string{"nextcloud", "immich", "minio-a", "minio-test"}
+
+	for name, want := range map[string]bool{"nextcloud": true, "immich": false, "minio-a": true, "minio-test": false} {
+		if cfg.SelectsApp(name) != want {
+			t.Errorf("SelectsApp(%s) should be %v", name, want)
+		}
+	}
+
+	// a failing app is reported and does not stop the others
+	client.failApps = []string{"nextcloud"}
+	err := addAsAppCertificateByID(client, cfg, inventory(t, client, cfg), 3)
+	if err == nil || !strings.Contains(err.Error(), "apps: nextcloud") {
+		t.Errorf("addAsAppCertificateByID should report nextcloud as failed, %v", err)
+	}
+	if strings.Join(client.updatedApps, ",") != "minio-a" {
+		t.Errorf("unexpected apps updated %v", client.updatedApps)
+	}
+}
+
+func TestFollowApps(t *testing.T) {
+	cfg := &config.Config{ConnectHost: "nas01.mydomain.com", Port: 443, Protocol: "wss", TimeoutSeconds: 10, AddAsAppCertificate: true}
+	cfg.CertBasename = "tnas-cert-deploy"
+	cfg.AppSelection = config.AppSelectionFollow
+	client, _ := NewClient(cfg.ServerURL(), false)
+	client.SetConfig(cfg)
+	client.apps = []string{"nextcloud", "immich", "minio", "plex"}
+	client.appCerts = map[string]int64{"nextcloud": 2, "immich": 7, "plex": 3}
+	certsList = map[string]int64{"tnas-cert-deploy-2024-12-31-0801683628": 2, "tnas-cert-deploy-2025-01-01-1735689600": 3,
+		"tnas-cert-deploy-other-2024-12-31-0801683628": 7}
+	defer func() { certsList = map[string]int64{} }()
+
+	// only nextcloud uses an older certificate of ours, immich uses another
+	// team's certificate and minio none
+	if !checkIfAppsNeedCertUpdate(cfg, inventory(t, client, cfg), 3) {
+		t.Errorf("nextcloud should need the new certificate")
+	}
+	if err := addAsAppCertificateByID(client, cfg, inventory(t, client, cfg), 3); err != nil {
+		t.Errorf("addAsAppCertificateByID failed with error: %v", err)
+	}
+	if strings.Join(client.updatedApps, ",") != "nextcloud" {
+		t.Errorf("unexpected apps updated %v", client.updatedApps)
+	}
+
+	client.appCerts["nextcloud"] = 3
+	if checkIfAppsNeedCertUpdate(cfg, inventory(t, client, cfg), 3) {
+		t.Errorf("no app should need an update")
+	}
+}
+
+func TestCertField(t *testing.T) {
+	cfg := &config.Config{ConnectHost: "nas01.mydomain.com", Port: 443, Protocol: "wss", TimeoutSeconds: 10, AddAsAppCertificate: true}
+	cfg.CertFields = []string{"nextcloud:values.nextcloud.certificate_id", "tls.certificate_id"}
+	client, _ := NewClient(cfg.ServerURL(), false)
+	client.SetConfig(cfg)
+	client.apps = []string{"nextcloud", "immich", "minio"}
+	client.appValues = map[string]map[string]interface{}{
+		"nextcloud": {"nextcloud": map[string]interface{}{"certificate_id": 2, "host": "cloud"}, "network": map[string]interface{}{"web_port": 80}},
+		"immich":    {"tls": map[string]interface{}{"enabled": true}},
+	}
+
+	// minio has no tls settings and is skipped
+	if err := addAsAppCertificateByID(client, cfg, inventory(t, client, cfg), 3); err != nil {
+		t.Errorf("addAsAppCertificateByID failed with error: %v", err)
+	}
+	want := map[string]interface{}{
+		"nextcloud": map[string]interface{}{"nextcloud": map[string]interface{}{"certificate_id": int64(3), "host": "cloud"}},
+		"immich":    map[string]interface{}{"tls": map[string]interface{}{"certificate_id": int64(3), "enabled": true}},
+	}
+	if !reflect.DeepEqual(client.appUpdates, want) {
+		t.Errorf("unexpected app updates %v", client.appUpdates)
+	}
+}
+
+func TestAppHealth(t *testing.T) {
+	appPollInterval = 10 * time.Millisecond
+	cfg := &config.Config{ConnectHost: "nas01.mydomain.com", Port: 443, Protocol: "wss", TimeoutSeconds: 10, AddAsAppCertificate: true}
+	cfg.AppHealthTimeout = 1
+	cfg.StoppedApps = config.StoppedAppsStart
+	client, _ := NewClient(cfg.ServerURL(), false)
+	client.SetConfig(cfg)
+	client.apps = []string{"nextcloud", "immich", "minio"}
+	client.appStates = map[string]string{"immich": "CRASHED", "minio": "STOPPED"}
+
+	// minio is started, immich does not become healthy
+	err := addAsAppCertificateByID(client, cfg, inventory(t, client, cfg), 3)
+	if err == nil || !strings.Contains(err.Error(), "apps: immich") {
+		t.Errorf("addAsAppCertificateByID should report immich as failed, %v", err)
+	}
+	if client.appStates["minio"] != "RUNNING" {
+		t.Errorf("minio should have been started")
+	}
+
+	// a deploying app that never runs times out
+	client.appStates = map[string]string{"nextcloud": "DEPLOYING"}
+	if err = waitForApp(client, cfg, "nextcloud"); err == nil || !strings.Contains(err.Error(), "is DEPLOYING") {
+		t.Errorf("waitForApp should time out, %v", err)
+	}
+
+	// with stopped_apps = skip a stopped app is not updated
+	cfg.StoppedApps = config.StoppedAppsSkip
+	client.apps = []string{"minio"}
+	client.appStates = map[string]string{"minio": "STOPPED"}
+	client.updatedApps = nil
+	if err = addAsAppCertificateByID(client, cfg, inventory(t, client, cfg), 3); err != nil || client.updatedApps != nil {
+		t.Errorf("minio should not be updated, %v, %v", client.updatedApps, err)
+	}
+}
+
+func TestAppRestore(t *testing.T) {
+	appPollInterval = 10 * time.Millisecond
+	cfg := &config.Config{ConnectHost: "nas01.mydomain.com", Port: 443, Protocol: "wss", TimeoutSeconds: 10, AddAsAppCertificate: true}
+	cfg.AppHealthTimeout = 1
+	client, _ := NewClient(cfg.ServerURL(), false)
+	client.SetConfig(cfg)
+	client.apps = []string{"nextcloud", "immich"}
+	client.appCerts = map[string]int64{"nextcloud": 2, "immich": 2}
+	client.appStates = map[string]string{"immich": "CRASHED"}
+
+	// immich crashes on the new certificate and is put back on certificate 2
+	err := addAsAppCertificateByID(client, cfg, inventory(t, client, cfg), 3)
+	if err == nil || !strings.Contains(err.Error(), "apps: immich") {
+		t.Errorf("addAsAppCertificateByID should report immich as failed, %v", err)
+	}
+	if !reflect.DeepEqual(client.updatedApps, []string{"nextcloud", "immich", "immich"}) {
+		t.Errorf("immich should be updated and restored, %v", client.updatedApps)
+	}
+	network := func(name string) int64 {
+		return currentCertificateID(client.appUpdates[name].(map[string]interface{}), []string{"network", "certificate_id"})
+	}
+	if network("nextcloud") != 3 || network("immich") != 2 {
+		t.Errorf("nextcloud should keep certificate 3 and immich be restored to 2, %v", client.appUpdates)
+	}
+}
+
+func TestAppParallel(t *testing.T) {
+	cfg := &config.Config{ConnectHost: "nas01.mydomain.com", Port: 443, Protocol: "wss", TimeoutSeconds: 10, AddAsAppCertificate: true}
+	cfg.AppParallel = 4
+	client, _ := NewClient(cfg.ServerURL(), false)
+	client.SetConfig(cfg)
+	client.apps = []string{"nextcloud", "immich", "minio", "plex", "jellyfin"}
+	client.failApps = []string{"immich"}
+
+	// the four updates run together, each mock job takes 2 seconds
+	start := time.Now()
+	err := addAsAppCertificateByID(client, cfg, inventory(t, client, cfg), 3)
+	if err == nil || !strings.Contains(err.Error(), "apps: immich") {
+		t.Errorf("addAsAppCertificateByID should report immich as failed, %v", err)
+	}
+	if len(client.updatedApps) != 4 {
+		t.Errorf("the other apps should be updated, %v", client.updatedApps)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the app updates did not run in parallel, took %v", elapsed)
+	}
+}
+
+// serialClient serializes the calls only, two app.update jobs started through
+// it are monitored at the same time
+func TestSerialClientJobs(t *testing.T) {
+	cfg := &config.Config{ConnectHost: "nas01.mydomain.com", Port: 443, Protocol: "wss", TimeoutSeconds: 10}
+	client, _ := NewClient(cfg.ServerURL(), false)
+	client.SetConfig(cfg)
+	serial := &serialClient{Client: client}
+
+	// each mock job takes 2 seconds, the errors are reported back to the test goroutine
+	start := time.Now()
+	errs := make(chan error, 2)
+	for _, name := range []string{"nextcloud", "immich"} {
+		go func(name string) {
+			params := []interface{}{name, map[string]interface{}{"values": map[string]interface{}{}}}
+			errs <- runJob(serial, cfg, "app.update", params, "updating app "+name)
+		}(name)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("runJob failed with error: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("the app.update jobs were monitored one after the other, took %v", elapsed)
+	}
+	if len(client.updatedApps) != 2 {
+		t.Errorf("both apps should be updated, %v", client.updatedApps)
+	}
+}
+
+func TestInventory(t *testing.T) {
+	cfg, err := config.New("test_files/tnas-cert.ini", "default")
+	if err != nil {
+		t.Fatalf("New config failed with error: %v", err)
+	}
+	client, _ := NewClient(cfg.ServerURL(), false)
+	client.SetConfig(cfg)
+	client.apps = []string{"nextcloud", "immich"}
+
+	inv := inventory(t, client, cfg)
+	if inv.Services[config.BindUI] != 1 || inv.Services[config.BindFTP] != 2 || len(inv.Apps) != 2 || len(inv.Certificates) != 3 {
+		t.Errorf("unexpected inventory %+v", inv)
+	}
+	client.appCerts = map[string]int64{"nextcloud": 2, "immich": 2}
+	cfg.AddAsUiCertificate = false
+	if !bindingsNeedUpdate(cfg, inventory(t, client, cfg), 1) || bindingsNeedUpdate(cfg, inventory(t, client, cfg), 2) {
+		t.Errorf("only certificate 2 is used by the FTP service and the apps")
+	}
+	cfg.AddAsUiCertificate = true
+
+	// the app configs are read over up to app_connections connections
+	client.apps = []string{"a1", "a2", "a3", "a4", "a5", "a6"}
+	client.connections = 0
+	if inv = inventory(t, client, cfg); len(inv.Apps) != 6 || client.connections != 3 {
+		t.Errorf("expected 6 apps read over 4 connections, got %d apps and %d extra connections", len(inv.Apps), client.connections)
+	}
+	for _, app := range inv.Apps {
+		if app.Err != nil || app.Values == nil {
+			t.Errorf("app %s was not read, %v", app.Name(), app.Err)
+		}
+	}
+	client.apps = []string{"nextcloud", "immich"}
+
+	// each app config is read once, the mock lists the certificate as already
+	// installed so the certificates are not read again, and the UI certificate
+	// is read back after its update
+	client.calls = nil
+	client.appCerts = nil
+	client.connections = 0
+	bundle, err := certfile.Load(cfg.FullChainPath, cfg.Private_key_path, certfile.Options{})
+	if err != nil {
+		t.Fatalf("loading the certificate key pair failed with error: %v", err)
+	}
+	if err = InstallCertificate(client, cfg, bundle); err != nil {
+		t.Errorf("install certificate failed with error: %v", err)
+	}
+	if client.calls["app.config"] != 2 || client.calls["app.certificate_choices"] != 1 || client.calls["system.general.config"] != 2 || client.connections != 1 {
+		t.Errorf("unexpected calls %v", client.calls)
+	}
+}
+
+func TestBindings(t *testing.T) {
+	for _, name := range config.BindNames {
+		if b, ok := registeredBindings[name]; !ok || b.Name() != name {
+			t.Errorf("bind %s has no binding", name)
+		}
+	}
+	if len(registeredBindings) != len(config.BindNames) {
+		t.Errorf("config.BindNames does not list every binding")
+	}
+
+	cfg := &config.Config{ConnectHost: "nas01.mydomain.com", Port: 443, Protocol: "wss", TimeoutSeconds: 10}
+	cfg.AddAsFTPCertificate = true
+	cfg.Bind = []string{config.BindWebDAV, config.BindLDAP, config.BindFTP}
+	client, _ := NewClient(cfg.ServerURL(), false)
+	client.SetConfig(cfg)
+
+	inv := inventory(t, client, cfg)
+	var names []string
+	for _, b := range inv.Bindings {
+		names = append(names, b.Name())
+	}
+	if !reflect.DeepEqual(names, []string{"ftp", "webdav", "ldap"}) || inv.Services[config.BindWebDAV] != -1 {
+		t.Errorf("unexpected bindings %v, services %v", names, inv.Services)
+	}
+	if !bindingsNeedUpdate(cfg, inv, 2) {
+		t.Errorf("webdav and ldap do not use certificate 2")
+	}
+
+	// ldap.update is a job, the others are plain calls
+	for _, b := range inv.Bindings[1:] {
+		if err := bind(client, cfg, inv, b, 2); err != nil {
+			t.Errorf("binding %s failed with error: %v", b.Name(), err)
+		}
+	}
+	if bindingsNeedUpdate(cfg, inventory(t, client, cfg), 2) {
+		t.Errorf("every service should use certificate 2, %v", client.services)
+	}
+
+	// an update that does not take is restored
+	client.failUpdates = []string{"webdav"}
+	client.calls = nil
+	err := bind(client, cfg, inv, registeredBindings[config.BindWebDAV], 3)
+	if err == nil || !strings.Contains(err.Error(), "is ID 2 after the update to ID 3") || client.calls["webdav.update"] != 2 {
+		t.Errorf("the webdav binding should fail and be restored, %v, %v", client.calls, err)
+	}
+}
+
+// add_as_ftp_certificate updates the FTP service, it was a no-op before bind
+func TestFTPCertificate(t *testing.T) {
+	cfg := &config.Config{ConnectHost: "nas01.mydomain.com", Port: 443, Protocol: "wss", TimeoutSeconds: 10}
+	cfg.AddAsFTPCertificate = true
+	client, _ := NewClient(cfg.ServerURL(), false)
+	client.SetConfig(cfg)
+
+	inv := inventory(t, client, cfg)
+	if len(inv.Bindings) != 1 || inv.Bindings[0].Name() != config.BindFTP {
+		t.Fatalf("add_as_ftp_certificate should bind ftp, got %v", inv.Bindings)
+	}
+	if err := bind(client, cfg, inv, inv.Bindings[0], 3); err != nil {
+		t.Errorf("binding the FTP certificate failed with error: %v", err)
+	}
+	if client.calls["ftp.update"] != 1 || certificateID(client.service("ftp")["ssltls_certificate"]) != 3 {
+		t.Errorf("the FTP certificate should be updated to ID 3, %v, %v", client.calls, client.services)
+	}
+}
+
+// a self signed certificate and its key, pem encoded
+func selfSigned(t *testing.T, template *x509.Certificate) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating a key failed with error: %v", err)
+	}
+	template.SerialNumber = big.NewInt(1)
+	template.NotBefore = time.Now()
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating a certificate failed with error: %v", err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("encoding a key failed with error: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestKMIPBinding(t *testing.T) {
+	// a self signed CA for ca_path
+	caPem, _ := selfSigned(t, &x509.Certificate{Subject: pkix.Name{CommonName: "kmip ca"}, IsCA: true, BasicConstraintsValid: true})
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caPath, caPem, 0o644)
+	if err != nil {
+		t.Fatalf("writing the CA failed with error: %v", err)
+	}
+
+	cfg := &config.Config{ConnectHost: "nas01.mydomain.com", Port: 443, Protocol: "wss", TimeoutSeconds: 10}
+	cfg.Bind = []string{config.BindKMIP}
+	cfg.CaPath = caPath
+	client, _ := NewClient(cfg.ServerURL(), false)
+	client.SetConfig(cfg)
+	client.service("kmip")["enabled"] = true
+	client.service("kmip")["server"] = "kmip.mydomain.com"
+	client.service("kmip")["certificate"] = 2
+
+	// the certificate is in place but the CA has not been imported
+	inv := inventory(t, client, cfg)
+	if inv.CA != 0 || !bindingsNeedUpdate(cfg, inv, 2) {
+		t.Errorf("the KMIP certificate authority should need an update, CA %d", inv.CA)
+	}
+	if err = bind(client, cfg, inv, inv.Bindings[0], 3); err != nil {
+		t.Fatalf("binding KMIP failed with error: %v", err)
+	}
+	kmip := client.service("kmip")
+	if certificateID(kmip["certificate"]) != 3 || certificateID(kmip["certificate_authority"]) != inv.CA || kmip["validate"] != true {
+		t.Errorf("unexpected KMIP config %v", kmip)
+	}
+
+	// the next run finds the imported CA
+	client.calls = nil
+	if inv = inventory(t, client, cfg); bindingsNeedUpdate(cfg, inv, 3) || client.calls["certificateauthority.create"] != 0 {
+		t.Errorf("KMIP should be up to date, %v", client.calls)
+	}
+
+	// the KMIP server is disabled by the update, the old certificate is put back
+	kmip["enabled"] = false
+	err = bind(client, cfg, inv, inv.Bindings[0], 4)
+	if err == nil || !strings.Contains(err.Error(), "enabled changed") {
+		t.Errorf("the KMIP binding should fail, %v", err)
+	}
+	if certificateID(kmip["certificate"]) != 3 || kmip["validate"] != false {
+		t.Errorf("the KMIP certificate should be restored without validation, %v", kmip)
+	}
+}
+
+func TestSyslogBinding(t *testing.T) {
+	cfg, err := config.New("test_files/tnas-cert.ini", "default")
+	if err != nil {
+		t.Fatalf("New config failed with error: %v", err)
+	}
+	cfg.AddAsUiCertificate, cfg.AddAsFTPCertificate, cfg.AddAsAppCertificate = false, false, false
+	cfg.Bind = []string{config.BindSyslog}
+	client, _ := NewClient(cfg.ServerURL(), false)
+	client.SetConfig(cfg)
+	client.service("system.advanced")["syslog_transport"] = "TLS"
+
+	// a server certificate is refused before any change
+	certPem, keyPem := selfSigned(t, &x509.Certificate{Subject: pkix.Name{CommonName: "nas01"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	err = InstallCertificate(client, cfg, certfile.NewBundle("test", certPem, keyPem))
+	if err == nil || !strings.Contains(err.Error(), "clientAuth") || client.calls["system.advanced.update"] != 0 {
+		t.Errorf("the syslog binding should refuse a server certificate, %v", err)
+	}
+
+	// a client certificate is bound without restarting the UI
+	certPem, keyPem = selfSigned(t, &x509.Certificate{Subject: pkix.Name{CommonName: "nas01"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	if err = InstallCertificate(client, cfg, certfile.NewBundle("test", certPem, keyPem)); err != nil {
+		t.Fatalf("install certificate failed with error: %v", err)
+	}
+	if certificateID(client.service("system.advanced")["syslog_tls_certificate"]) != 3 || client.calls["system.general.ui_restart"] != 0 {
+		t.Errorf("unexpected syslog config %v or calls %v", client.service("system.advanced"), client.calls)
+	}
+}
+
+func TestFileTargets(t *testing.T) {
+	appPollInterval = 10 * time.Millisecond
+	cfg := &config.Config{ConnectHost: "nas01.mydomain.com", Port: 443, Protocol: "wss", TimeoutSeconds: 10}
+	cfg.AppHealthTimeout = 1
+	cfg.Targets = []*config.FileTarget{
+		{Name: "nginx", Format: config.FileFormatPEM, CertPath: "/mnt/tank/nginx/cert.pem", KeyPath: "/mnt/tank/nginx/key.pem",
+			ChainPath: "/mnt/tank/nginx/chain.pem", FileMode: 0o640, RestartApp: "nginx", Restart: config.RestartRedeploy},
+		{Name: "plex", Format: config.FileFormatPKCS12, CertPath: "/mnt/tank/plex/cert.p12", Password: "secret",
+			Owner: "www-data", Group: "33", FileMode: 0o600},
+	}
+	client, _ := NewClient(cfg.ServerURL(), false)
+	client.SetConfig(cfg)
+	client.apps = []string{"nginx"}
+	store := newMemFileStore()
+	saved := newFileStore
+	defer func() { newFileStore = saved }()
+	newFileStore = func(Client, *config.Config) (FileStore, error) { return store, nil }
+
+	bundle, err := certfile.Load("test_files/fullchain.pem", "test_files/privkey.pem", certfile.Options{})
+	if err != nil {
+		t.Fatalf("loading the certificate key pair failed with error: %v", err)
+	}
+
+	// the first run writes every file, chowns the plex file and redeploys nginx
+	if err = deployFileTargets(client, cfg, bundle); err != nil {
+		t.Fatalf("deployFileTargets failed with error: %v", err)
+	}
+	if store.writes != 4 || !bytes.Equal(store.files["/mnt/tank/nginx/key.pem"], bundle.PrivateKey) || store.modes["/mnt/tank/nginx/cert.pem"] != 0o640 {
+		t.Errorf("unexpected files written, %d writes", store.writes)
+	}
+	if !bundle.SamePKCS12(store.files["/mnt/tank/plex/cert.p12"], "secret") {
+		t.Errorf("the PKCS#12 file does not hold the key pair")
+	}
+	if !reflect.DeepEqual(client.chowned, []string{"/mnt/tank/plex/cert.p12"}) || !reflect.DeepEqual(client.restarted, []string{"nginx"}) {
+		t.Errorf("unexpected chown %v or restart %v", client.chowned, client.restarted)
+	}
+
+	// nothing changed, the PKCS#12 file is compared by content rather than bytes
+	if err = deployFileTargets(client, cfg, bundle); err != nil || store.writes != 4 || len(client.restarted) != 1 {
+		t.Errorf("unchanged files should not be written, %d writes, restarted %v, %v", store.writes, client.restarted, err)
+	}
+
+	// an unknown owner fails its target only
+	cfg.Targets[1].Owner = "nobody"
+	delete(store.files, "/mnt/tank/nginx/key.pem")
+	err = deployFileTargets(client, cfg, bundle)
+	if err == nil || !strings.Contains(err.Error(), "file targets: plex") || store.writes != 5 || len(client.restarted) != 2 {
+		t.Errorf("plex should fail and nginx be rewritten, %d writes, %v", store.writes, err)
+	}
+}
+
+func TestHTTPFileStore(t *testing.T) {
+	jobPollInterval = 10 * time.Millisecond
+	files := map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_upload/":
+			if r.Header.Get("Authorization") != "Token session-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, params, _ := strings.Cut(r.FormValue("data"), `"params":["`)
+			path, _, _ := strings.Cut(params, `"`)
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			files[path], _ = io.ReadAll(file)
+			fmt.Fprint(w, `{"job_id": 7}`)
+		case "/_download/1":
+			data, ok := files[r.URL.Query().Get("path")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{ConnectHost: "nas01.mydomain.com", Port: 443, Protocol: "wss", TimeoutSeconds: 10}
+	client, _ := NewClient(cfg.ServerURL(), false)
+	client.SetConfig(cfg)
+	store, err := newHTTPFileStore(client, cfg)
+	if err != nil || store.baseURL != "https://nas01.mydomain.com:443" {
+		t.Fatalf("newHTTPFileStore returned %v, %v", store, err)
+	}
+	store.baseURL = server.URL
+	store.http = server.Client()
+
+	if _, err = store.ReadFile("/mnt/tank/cert.pem"); err == nil {
+		t.Errorf("reading a missing file should fail")
+	}
+	if err = store.WriteFile("/mnt/tank/cert.pem", []byte("cert"), 0o600); err != nil {
+		t.Fatalf("WriteFile failed with error: %v", err)
+	}
+	if data, err := store.ReadFile("/mnt/tank/cert.pem"); err != nil || string(data) != "cert" {
+		t.Errorf("ReadFile returned %q, %v", data, err)
+	}
+}
+
+func TestPasswordLogin(t *testing.T) {
+	cfg := &config.Config{ConnectHost: "nas01.mydomain.com", Port: 443, Protocol: "wss", TimeoutSeconds: 10}
+	cfg.Username = "admin"
+	cfg.Password = "secret"
+	client, _ := NewClient(cfg.ServerURL(), false)
+	client.SetConfig(cfg)
+
+	if err := clientLogin(client, cfg); err != nil {
+		t.Errorf("password login failed with error: %v", err)
+	}
+
+	// an OTP challenge is answered from the TOTP secret
+	cfg.OtpSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	if err := clientLogin(client, cfg); err != nil {
+		t.Errorf("password login with otp failed with error: %v", err)
+	}
+	cfg.OtpSecret = ""
+
+	// with generate_token only the first login sends the password
+	cfg.GenerateToken = true
+	cfg.TokenTTL = 600
+	client.passwordLogins = 0
+	for i := 0; i < 3; i++ {
+		if err := clientLogin(client, cfg); err != nil {
+			t.Errorf("login %d failed with error: %v", i, err)
+		}
+	}
+	if client.passwordLogins != 1 {
+		t.Errorf("the password should have been sent once, sent %d times", client.passwordLogins)
+	}
+	delete(sessionTokens, cfg.ServerURL()+" "+cfg.Username)
+
+	cfg.Password = "wrong"
+	if err := clientLogin(client, cfg); err == nil {
+		t.Errorf("login should fail with the wrong password")
+	}
+}
+
+func TestTotp(t *testing.T) {
+	// RFC 6238 SHA1 test vectors, truncated to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	for unix, want := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924"} {
+		code, err := totp(secret, time.Unix(unix, 0))
+		if err != nil || code != want {
+			t.Errorf("totp at %d returned %s, %v, want %s", unix, code, err, want)
+		}
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	cfg, err := config.New("test_files/tnas-cert.ini", "default")
+	if err != nil {
+		t.Fatalf("New config failed with error: %v", err)
+	}
+	client, _ := NewClient(cfg.ServerURL(), cfg.TlsSkipVerify)
+	client.SetConfig(cfg)
+	if err = Login(client, cfg); err != nil {
+		t.Fatalf("Login failed with error: %v", err)
+	}
+
+	services, err := Discover(client, cfg)
+	if err != nil {
+		t.Fatalf("Discover failed with error: %v", err)
+	}
+	if len(services.Apps) != 1 || services.Apps[0].Name != "testapp" {
+		t.Errorf("unexpected apps %+v", services.Apps)
+	}
+	if services.UICertificate != "truenas_default" {
+		t.Errorf("unexpected UI certificate %s", services.UICertificate)
+	}
+	if !services.FTPTLS || services.FTPCertificate != "tnas-cert-deploy-2024-12-31-0801683628" {
+		t.Errorf("unexpected FTP settings %v %s", services.FTPTLS, services.FTPCertificate)
+	}
+	if len(services.Certificates) != 3 {
+		t.Errorf("unexpected certificates %v", services.Certificates)
+	}
+}
+
+func TestPrivileges(t *testing.T) {
+	cfg, err := config.New("test_files/tnas-cert.ini", "default")
+	if err != nil {
+		t.Fatalf("New config failed with error: %v", err)
+	}
+	cfg.AddAsUiCertificate = true
+	cfg.AddAsAppCertificate = true
+	client, _ := NewClient(cfg.ServerURL(), cfg.TlsSkipVerify)
+	client.SetConfig(cfg)
+
+	user, privileges, err := CheckPrivileges(client, cfg)
+	if err != nil || user != "certbot" {
+		t.Fatalf("CheckPrivileges returned %s, %v", user, err)
+	}
+	if err = MissingPrivileges(privileges); err != nil {
+		t.Errorf("FULL_ADMIN should hold every privilege, %v", err)
+	}
+
+	// a minimal role without app or UI access
+	client.roles = []string{"CERTIFICATE_WRITE", "APPS_WRITE"}
+	if _, privileges, err = CheckPrivileges(client, cfg); err != nil {
+		t.Fatalf("CheckPrivileges failed with error: %v", err)
+	}
+	err = MissingPrivileges(privileges)
+	if err == nil || !strings.Contains(err.Error(), "SYSTEM_GENERAL_WRITE") || strings.Contains(err.Error(), "APPS_READ") {
+		t.Errorf("unexpected missing privileges, %v", err)
+	}
+
+	// the check fails the install before any change
+	bundle, err := certfile.Load(cfg.FullChainPath, cfg.Private_key_path, certfile.Options{})
+	if err != nil {
+		t.Fatalf("loading the certificate key pair failed with error: %v", err)
+	}
+	if err = InstallCertificate(client, cfg, bundle); err == nil || !strings.Contains(err.Error(), "missing the privileges") {
+		t.Errorf("InstallCertificate should fail on missing privileges, %v", err)
+	}
+}
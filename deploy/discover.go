@@ -0,0 +1,144 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package deploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"tnascert-deploy/config"
+)
+
+// Services describes what a TrueNAS host can use a certificate for
+type Services struct {
+	Apps           []AppService // apps whose configuration has ix_certificates
+	UICertificate  string       // name of the certificate used by the web UI
+	FTPTLS         bool         // whether FTP has TLS enabled
+	FTPCertificate string       // name of the certificate used by FTP
+	Certificates   []string     // names of the installed certificates
+}
+
+// AppService is an app that accepts a certificate
+type AppService struct {
+	Name          string
+	CertificateID int64 // the certificate currently used by the app, -1 if none
+}
+
+type ServiceConfigResponse struct {
+	JsonRPC string                 `json:"jsonrpc"`
+	ID      int                    `json:"id"`
+	Result  map[string]interface{} `json:"result"`
+}
+
+// Login logs in with the api key or password configured in the section
+func Login(client Client, cfg *config.Config) error {
+	return clientLogin(client, cfg)
+}
+
+// Discover lists the installed certificates and the services on a logged in
+// client that can use a certificate
+func Discover(client Client, cfg *config.Config) (*Services, error) {
+	services := &Services{}
+
+	resp, err := client.Call("app.certificate_choices", cfg.TimeoutSeconds, []interface{}{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get a certificate list from the server, %v", err)
+	}
+	var certs CertificateListResponse
+	if err = json.Unmarshal(resp, &certs); err != nil {
+		return nil, fmt.Errorf("could not parse the certificate list, %v", err)
+	}
+	names := map[int64]string{}
+	for _, cert := range certs.Result {
+		name, _ := cert["name"].(string)
+		id, _ := cert["id"].(float64)
+		names[int64(id)] = name
+		services.Certificates = append(services.Certificates, name)
+	}
+	sort.Strings(services.Certificates)
+
+	resp, err = client.Call("app.query", cfg.TimeoutSeconds, []interface{}{})
+	if err != nil {
+		return nil, fmt.Errorf("app query failed, %v", err)
+	}
+	var apps AppListQueryResponse
+	if err = json.Unmarshal(resp, &apps); err != nil {
+		return nil, fmt.Errorf("could not parse the app list, %v", err)
+	}
+	for _, app := range apps.Result {
+		name, _ := app["name"].(string)
+		resp, err := client.Call("app.config", cfg.TimeoutSeconds, []interface{}{app["id"]})
+		if err != nil {
+			return nil, fmt.Errorf("app config query for %s failed, %v", name, err)
+		}
+		var appConfig AppConfigResponse
+		if err = json.Unmarshal(resp, &appConfig); err != nil {
+			return nil, fmt.Errorf("could not parse the app config of %s, %v", name, err)
+		}
+		if appConfig.Result.IxCertificates == nil {
+			continue
+		}
+		service := AppService{Name: name, CertificateID: -1}
+		if id, ok := appConfig.Result.Network["certificate_id"].(float64); ok {
+			service.CertificateID = int64(id)
+		}
+		services.Apps = append(services.Apps, service)
+	}
+
+	general, err := serviceConfig(client, cfg, "system.general.config")
+	if err != nil {
+		return nil, err
+	}
+	services.UICertificate = certificateName(general["ui_certificate"], names)
+
+	ftp, err := serviceConfig(client, cfg, "ftp.config")
+	if err != nil {
+		return nil, err
+	}
+	services.FTPTLS, _ = ftp["tls"].(bool)
+	services.FTPCertificate = certificateName(ftp["ssltls_certificate"], names)
+	return services, nil
+}
+
+func serviceConfig(client Client, cfg *config.Config, method string) (map[string]interface{}, error) {
+	resp, err := client.Call(method, cfg.TimeoutSeconds, []interface{}{})
+	if err != nil {
+		return nil, fmt.Errorf("%s failed, %v", method, err)
+	}
+	var response ServiceConfigResponse
+	if err = json.Unmarshal(resp, &response); err != nil {
+		return nil, fmt.Errorf("could not parse the %s response, %v", method, err)
+	}
+	return response.Result, nil
+}
+
+// a certificate is referenced by id, or by an extended object holding its name
+func certificateName(value interface{}, names map[int64]string) string {
+	switch v := value.(type) {
+	case float64:
+		if name, ok := names[int64(v)]; ok {
+			return name
+		}
+		return fmt.Sprintf("id %d", int64(v))
+	case map[string]interface{}:
+		if name, ok := v["name"].(string); ok {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/*
+ * Reads and writes NAS files through the middleware filesystem.get and
+ * filesystem.put methods, whose file contents travel over HTTP.
+ */
+
+package deploy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+	"tnascert-deploy/config"
+)
+
+// FileStore reads and writes files on the NAS
+type FileStore interface {
+	ReadFile(path string) ([]byte, error)
+	WriteFile(path string, data []byte, mode uint32) error
+}
+
+// the FileStore used by the file targets, tests replace it
+var newFileStore = func(client Client, cfg *config.Config) (FileStore, error) {
+	return newHTTPFileStore(client, cfg)
+}
+
+// how often core.get_jobs is polled while waiting for an upload
+var jobPollInterval = 500 * time.Millisecond
+
+type CoreJobsResponse struct {
+	JsonRPC string `json:"jsonrpc"`
+	ID      int    `json:"id"`
+	Result  []struct {
+		State string `json:"state"`
+		Error string `json:"error"`
+	} `json:"result"`
+}
+
+type CoreDownloadResponse struct {
+	JsonRPC string        `json:"jsonrpc"`
+	ID      int           `json:"id"`
+	Result  []interface{} `json:"result"` // the job id and the url to download from
+}
+
+// httpFileStore posts to /_upload and reads from the urls core.download
+// returns, authenticated with a generated token
+type httpFileStore struct {
+	client  Client
+	cfg     *config.Config
+	http    *http.Client
+	baseURL string // http or https scheme, host and port of the NAS
+	token   string
+}
+
+func newHTTPFileStore(client Client, cfg *config.Config) (*httpFileStore, error) {
+	token, err := generateToken(client, cfg)
+	if err != nil {
+		return nil, err
+	}
+	scheme := "https"
+	if cfg.Protocol == config.WS {
+		scheme = "http"
+	}
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: cfg.TlsSkipVerify}}
+	return &httpFileStore{
+		client:  client,
+		cfg:     cfg,
+		http:    &http.Client{Transport: transport, Timeout: time.Duration(cfg.TimeoutSeconds) * time.Second},
+		baseURL: fmt.Sprintf("%s://%s:%d", scheme, cfg.ConnectHost, cfg.Port),
+		token:   token,
+	}, nil
+}
+
+// ReadFile downloads a file with the filesystem.get job
+func (s *httpFileStore) ReadFile(path string) ([]byte, error) {
+	params := []interface{}{"filesystem.get", []interface{}{path}, "file", false}
+	resp, err := s.client.Call("core.download", s.cfg.TimeoutSeconds, params)
+	if err != nil {
+		return nil, fmt.Errorf("core.download of %s failed, %v", path, err)
+	}
+	var response CoreDownloadResponse
+	if err = json.Unmarshal(resp, &response); err != nil {
+		return nil, fmt.Errorf("could not parse the core.download response, %v", err)
+	}
+	if len(response.Result) != 2 {
+		return nil, fmt.Errorf("core.download of %s returned no url", path)
+	}
+	url, _ := response.Result[1].(string)
+	if !strings.HasPrefix(url, "/") {
+		return nil, fmt.Errorf("core.download of %s returned no url", path)
+	}
+
+	res, err := s.http.Get(s.baseURL + url)
+	if err != nil {
+		return nil, fmt.Errorf("download of %s failed, %v", path, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download of %s failed, %s", path, res.Status)
+	}
+	return io.ReadAll(res.Body)
+}
+
+// WriteFile uploads a file with the filesystem.put job and waits for the job
+func (s *httpFileStore) WriteFile(path string, data []byte, mode uint32) error {
+	call, err := json.Marshal(map[string]interface{}{
+		"method": "filesystem.put",
+		"params": []interface{}{path, map[string]interface{}{"mode": mode}},
+	})
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if err = form.WriteField("data", string(call)); err != nil {
+		return err
+	}
+	file, err := form.CreateFormFile("file", "file")
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		return err
+	}
+	if err = form.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.baseURL+"/_upload/", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Token "+s.token)
+	res, err := s.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("upload of %s failed, %v", path, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("upload of %s failed, %s", path, res.Status)
+	}
+	var upload struct {
+		JobID int64 `json:"job_id"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&upload); err != nil {
+		return fmt.Errorf("could not parse the upload response, %v", err)
+	}
+	if err = s.waitForJob(upload.JobID); err != nil {
+		return fmt.Errorf("writing %s failed, %v", path, err)
+	}
+	return nil
+}
+
+// poll core.get_jobs until the job ends
+func (s *httpFileStore) waitForJob(id int64) error {
+	deadline := time.Now().Add(time.Duration(s.cfg.TimeoutSeconds) * time.Second)
+	filters := []interface{}{[]interface{}{"id", "=", id}}
+	for {
+		resp, err := s.client.Call("core.get_jobs", s.cfg.TimeoutSeconds, []interface{}{filters})
+		if err != nil {
+			return fmt.Errorf("core.get_jobs failed, %v", err)
+		}
+		var response CoreJobsResponse
+		if err = json.Unmarshal(resp, &response); err != nil {
+			return fmt.Errorf("could not parse the job list, %v", err)
+		}
+		if len(response.Result) == 0 {
+			return fmt.Errorf("job %d not found", id)
+		}
+		switch job := response.Result[0]; job.State {
+		case "SUCCESS":
+			return nil
+		case "FAILED", "ABORTED":
+			return fmt.Errorf("job %d %s, %s", id, strings.ToLower(job.State), job.Error)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("job %d timed out after %d seconds", id, s.cfg.TimeoutSeconds)
+		}
+		time.Sleep(jobPollInterval)
+	}
+}
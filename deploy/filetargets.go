@@ -0,0 +1,217 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/*
+ * File targets write the certificate to NAS paths for the services, such as
+ * custom apps, that read it from disk rather than from the certificate store.
+ */
+
+package deploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"tnascert-deploy/certfile"
+	"tnascert-deploy/config"
+)
+
+// a file of a file target and its content
+type targetFile struct {
+	path string
+	data []byte
+}
+
+// the files a target writes in its format
+func targetFiles(t *config.FileTarget, bundle *certfile.Bundle) ([]targetFile, error) {
+	switch t.Format {
+	case config.FileFormatCombined:
+		return []targetFile{{t.CertPath, bundle.Combined()}}, nil
+	case config.FileFormatPKCS12:
+		data, err := bundle.PKCS12(t.Password)
+		if err != nil {
+			return nil, err
+		}
+		return []targetFile{{t.CertPath, data}}, nil
+	case config.FileFormatDER:
+		cert, key, err := bundle.DER()
+		if err != nil {
+			return nil, err
+		}
+		return []targetFile{{t.CertPath, cert}, {t.KeyPath, key}}, nil
+	}
+
+	// pem, the certificate holds its chain unless the chain has a file of its own
+	if t.ChainPath == "" {
+		return []targetFile{{t.CertPath, bundle.Certificate}, {t.KeyPath, bundle.PrivateKey}}, nil
+	}
+	leaf, err := bundle.Leaf()
+	if err != nil {
+		return nil, err
+	}
+	chain, err := bundle.Chain()
+	if err != nil {
+		return nil, err
+	}
+	return []targetFile{{t.CertPath, leaf}, {t.KeyPath, bundle.PrivateKey}, {t.ChainPath, chain}}, nil
+}
+
+// whether the file on the NAS differs, a file that cannot be read has changed
+func fileChanged(store FileStore, t *config.FileTarget, bundle *certfile.Bundle, file targetFile) bool {
+	current, err := store.ReadFile(file.path)
+	if err != nil {
+		return true
+	}
+	if t.Format == config.FileFormatPKCS12 {
+		return !bundle.SamePKCS12(current, t.Password)
+	}
+	return !bytes.Equal(current, file.data)
+}
+
+// write the file targets of the section, restarting the app of a target
+// whose files changed
+func deployFileTargets(client Client, cfg *config.Config, bundle *certfile.Bundle) error {
+	if len(cfg.Targets) == 0 {
+		return nil
+	}
+	store, err := newFileStore(client, cfg)
+	if err != nil {
+		return fmt.Errorf("could not access the NAS files, %v", err)
+	}
+
+	var failed []string
+	for _, t := range cfg.Targets {
+		changed, err := deployFileTarget(client, cfg, store, t, bundle)
+		if err != nil {
+			log.Printf("file target %s failed, %v", t.Name, err)
+			failed = append(failed, t.Name)
+			continue
+		}
+		if !changed {
+			log.Printf("file target %s is up to date", t.Name)
+			continue
+		}
+		log.Printf("file target %s has been written", t.Name)
+		if t.RestartApp == "" {
+			continue
+		}
+		if err = restartApp(client, cfg, t.RestartApp, t.Restart); err != nil {
+			log.Printf("file target %s, %v", t.Name, err)
+			failed = append(failed, t.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("writing the certificate failed for file targets: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// write the changed files of a target, reporting whether any changed
+func deployFileTarget(client Client, cfg *config.Config, store FileStore, t *config.FileTarget, bundle *certfile.Bundle) (bool, error) {
+	files, err := targetFiles(t, bundle)
+	if err != nil {
+		return false, err
+	}
+	uid, gid, err := fileOwner(client, cfg, t)
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+	for _, file := range files {
+		if !fileChanged(store, t, bundle, file) {
+			continue
+		}
+		if err = store.WriteFile(file.path, file.data, t.FileMode); err != nil {
+			return changed, err
+		}
+		changed = true
+		if cfg.Debug {
+			log.Printf("wrote %s", file.path)
+		}
+		if uid >= 0 || gid >= 0 {
+			if err = chown(client, cfg, file.path, uid, gid); err != nil {
+				return changed, err
+			}
+		}
+	}
+	return changed, nil
+}
+
+// the uid and gid of the owner and group of a target, -1 when not set
+func fileOwner(client Client, cfg *config.Config, t *config.FileTarget) (int64, int64, error) {
+	uid, err := accountID(client, cfg, "user.query", "username", "uid", t.Owner)
+	if err != nil {
+		return -1, -1, err
+	}
+	gid, err := accountID(client, cfg, "group.query", "group", "gid", t.Group)
+	if err != nil {
+		return -1, -1, err
+	}
+	return uid, gid, nil
+}
+
+// the id of a user or group given by name or number, -1 when not set
+func accountID(client Client, cfg *config.Config, method string, nameField string, idField string, name string) (int64, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if id, err := strconv.ParseInt(name, 10, 64); err == nil {
+		return id, nil
+	}
+	filters := []interface{}{[]interface{}{nameField, "=", name}}
+	resp, err := client.Call(method, cfg.TimeoutSeconds, []interface{}{filters})
+	if err != nil {
+		return -1, fmt.Errorf("%s failed, %v", method, err)
+	}
+	var response AppListQueryResponse
+	if err = json.Unmarshal(resp, &response); err != nil {
+		return -1, fmt.Errorf("could not parse the %s response, %v", method, err)
+	}
+	if len(response.Result) == 0 {
+		return -1, fmt.Errorf("%s %s not found", nameField, name)
+	}
+	id, ok := response.Result[0][idField].(float64)
+	if !ok {
+		return -1, fmt.Errorf("%s %s has no %s", nameField, name, idField)
+	}
+	return int64(id), nil
+}
+
+// set the owner and group of a file with the filesystem.chown job
+func chown(client Client, cfg *config.Config, path string, uid int64, gid int64) error {
+	args := map[string]interface{}{"path": path}
+	if uid >= 0 {
+		args["uid"] = uid
+	}
+	if gid >= 0 {
+		args["gid"] = gid
+	}
+	return runJob(client, cfg, "filesystem.chown", []interface{}{args}, "changing the owner of "+path)
+}
+
+// restart or redeploy an app and wait for it to run
+func restartApp(client Client, cfg *config.Config, name string, restart string) error {
+	if err := runJob(client, cfg, "app."+restart, []interface{}{name}, restart+" of app "+name); err != nil {
+		return err
+	}
+	log.Printf("app %s has been %sed", name, restart)
+	return waitForApp(client, cfg, name)
+}
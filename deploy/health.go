@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package deploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+	"tnascert-deploy/config"
+)
+
+// app states reported by app.query
+const (
+	AppStateRunning = "RUNNING"
+	AppStateStopped = "STOPPED"
+	AppStateCrashed = "CRASHED"
+)
+
+// how often app.query is polled while waiting for an app to run
+var appPollInterval = 5 * time.Second
+
+// the state of the named app
+func appState(client Client, cfg *config.Config, name string) (string, error) {
+	filters := []interface{}{[]interface{}{"name", "=", name}}
+	resp, err := client.Call("app.query", cfg.TimeoutSeconds, []interface{}{filters})
+	if err != nil {
+		return "", fmt.Errorf("app query failed, %v", err)
+	}
+	var response AppListQueryResponse
+	if err = json.Unmarshal(resp, &response); err != nil {
+		return "", fmt.Errorf("could not parse the app list, %v", err)
+	}
+	if len(response.Result) == 0 {
+		return "", fmt.Errorf("app %s not found", name)
+	}
+	state, _ := response.Result[0]["state"].(string)
+	return state, nil
+}
+
+// poll app.query until the app is RUNNING, failing when it crashes or does
+// not run within app_health_timeout
+func waitForApp(client Client, cfg *config.Config, name string) error {
+	deadline := time.Now().Add(time.Duration(cfg.AppHealthTimeout) * time.Second)
+	state := ""
+	for {
+		current, err := appState(client, cfg, name)
+		if err != nil {
+			log.Printf("could not read the state of app %s, %v", name, err)
+		} else {
+			state = current
+		}
+		switch state {
+		case AppStateRunning:
+			log.Printf("app %s is %s", name, state)
+			return nil
+		case AppStateCrashed:
+			return fmt.Errorf("app %s crashed after the certificate update", name)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("app %s is %s, not %s after %d seconds", name, state, AppStateRunning, cfg.AppHealthTimeout)
+		}
+		if cfg.Debug {
+			log.Printf("waiting for app %s, it is %s", name, state)
+		}
+		time.Sleep(appPollInterval)
+	}
+}
+
+// start a stopped app and wait for the start job
+func startApp(client Client, cfg *config.Config, name string) error {
+	return runJob(client, cfg, "app.start", []interface{}{name}, "starting app "+name)
+}
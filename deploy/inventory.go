@@ -0,0 +1,207 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package deploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"tnascert-deploy/config"
+
+	"github.com/truenas/api_client_golang/truenas_api"
+)
+
+// Inventory is a snapshot of the certificates and of the services the section
+// binds them to, taken once at the start of a deployment so that the decisions
+// need no further round trips. Only objects that change are read again.
+type Inventory struct {
+	Certificates []map[string]interface{}          // app.certificate_choices
+	Bindings     []Binding                         // the services of the section, in the order they are bound
+	Services     map[string]int64                  // the certificate id used by each service binding, -1 if none
+	Configs      map[string]map[string]interface{} // the config of each service binding
+	CA           int64                             // the id of the ca_path certificate authority, 0 when not imported yet
+	Apps         []*InventoryApp                   // the selected apps, when binding apps
+}
+
+// InventoryApp is an app from app.query with its values from app.config
+type InventoryApp struct {
+	App    map[string]interface{}
+	Values map[string]interface{}
+	Err    error // the app.config call failed
+}
+
+func (a *InventoryApp) Name() string {
+	name, _ := a.App["name"].(string)
+	return name
+}
+
+// take the snapshot of what the section uses. The api client has one
+// websocket connection taking a single writer, so the bindings are read one
+// after another and the app configs over a pool of connections.
+func takeInventory(client Client, cfg *config.Config) (*Inventory, error) {
+	bindings, err := sectionBindings(cfg)
+	if err != nil {
+		return nil, err
+	}
+	inv := &Inventory{Bindings: bindings, Services: map[string]int64{}, Configs: map[string]map[string]interface{}{}}
+
+	resp, err := client.Call("app.certificate_choices", cfg.TimeoutSeconds, []interface{}{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get a certificate list from the server, %v", err)
+	}
+	var certs CertificateListResponse
+	if err = json.Unmarshal(resp, &certs); err != nil {
+		return nil, fmt.Errorf("could not parse the certificate list, %v", err)
+	}
+	inv.Certificates = certs.Result
+
+	for _, b := range bindings {
+		if err = b.Current(client, cfg, inv); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Debug {
+		log.Printf("inventory: %d certificates, service certificates %v, %d apps",
+			len(inv.Certificates), inv.Services, len(inv.Apps))
+	}
+	return inv, nil
+}
+
+// the selected apps with their values
+func takeAppInventory(client Client, cfg *config.Config) ([]*InventoryApp, error) {
+	resp, err := client.Call("app.query", cfg.TimeoutSeconds, []interface{}{})
+	if err != nil {
+		return nil, fmt.Errorf("app query failed, %v", err)
+	}
+	if cfg.Debug {
+		log.Printf("app query response: %v", string(resp))
+	}
+	var apps AppListQueryResponse
+	if err = json.Unmarshal(resp, &apps); err != nil {
+		return nil, fmt.Errorf("could not parse the app list, %v", err)
+	}
+	var selected []*InventoryApp
+	for _, app := range selectApps(cfg, apps.Result) {
+		selected = append(selected, &InventoryApp{App: app})
+	}
+
+	// the websocket connection takes a single writer, so the configs are
+	// fetched concurrently over extra connections, each reading its own share
+	conns := append([]Client{client}, openConnections(client, cfg, min(int(cfg.AppConnections), len(selected))-1)...)
+	work := make(chan *InventoryApp)
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn Client) {
+			defer wg.Done()
+			for a := range work {
+				a.Values, a.Err = appValues(conn, cfg, a.App)
+			}
+		}(conn)
+	}
+	for _, a := range selected {
+		work <- a
+	}
+	close(work)
+	wg.Wait()
+	for _, conn := range conns[1:] {
+		conn.Close()
+	}
+	return selected, nil
+}
+
+// opens a connection to the NAS, replaced by the tests. client is the
+// logged in connection the new one is added to.
+var newConnection = func(client Client, cfg *config.Config) (Client, error) {
+	return truenas_api.NewClient(cfg.ServerURL(), !cfg.TlsSkipVerify)
+}
+
+// open up to n extra connections logged in with a session token generated on
+// client, fewer when some cannot be opened
+func openConnections(client Client, cfg *config.Config, n int) []Client {
+	if n <= 0 {
+		return nil
+	}
+	token, err := generateToken(client, cfg)
+	if err != nil {
+		log.Printf("the app configs are read over one connection, %v", err)
+		return nil
+	}
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		conns []Client
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := newConnection(client, cfg)
+			if err != nil {
+				log.Printf("could not open an extra connection, %v", err)
+				return
+			}
+			err = loginEx(conn, cfg, "auth.login_ex", map[string]interface{}{
+				"mechanism": "TOKEN_PLAIN",
+				"token":     token,
+			})
+			if err != nil {
+				log.Printf("could not log in an extra connection, %v", err)
+				conn.Close()
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if cfg.Debug {
+		log.Printf("reading the app configs over %d connections", len(conns)+1)
+	}
+	return conns
+}
+
+// the values of an app from app.config
+func appValues(client Client, cfg *config.Config, app map[string]interface{}) (map[string]interface{}, error) {
+	resp, err := client.Call("app.config", cfg.TimeoutSeconds, []interface{}{app["id"]})
+	if err != nil {
+		return nil, fmt.Errorf("app config query failed, %v", err)
+	}
+	var response AppValuesResponse
+	if err = json.Unmarshal(resp, &response); err != nil {
+		return nil, fmt.Errorf("app config query failed, %v", err)
+	}
+	return response.Result, nil
+}
+
+// a certificate is referenced by id, or by an extended object holding its id,
+// -1 when there is none
+func certificateID(value interface{}) int64 {
+	switch v := value.(type) {
+	case float64:
+		return int64(v)
+	case map[string]interface{}:
+		if id, ok := v["id"].(float64); ok {
+			return int64(id)
+		}
+	}
+	return -1
+}
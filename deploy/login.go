@@ -0,0 +1,187 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package deploy
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"tnascert-deploy/config"
+)
+
+// auth.login_ex response types
+const (
+	loginSuccess     = "SUCCESS"
+	loginOtpRequired = "OTP_REQUIRED"
+	loginAuthErr     = "AUTH_ERR"
+	loginExpired     = "EXPIRED"
+)
+
+type LoginExResponse struct {
+	JsonRPC string `json:"jsonrpc"`
+	ID      int    `json:"id"`
+	Result  struct {
+		ResponseType string `json:"response_type"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type GenerateTokenResponse struct {
+	JsonRPC string `json:"jsonrpc"`
+	ID      int    `json:"id"`
+	Result  string `json:"result"`
+	Error   *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// tokens generated after a password login, by server URL and username, so
+// that later logins in the same run do not send the password again
+var sessionTokens = map[string]string{}
+
+// log in with username and password using the auth.login_ex flow, answering
+// an OTP challenge from the TOTP secret when one is configured
+func passwordLogin(client Client, cfg *config.Config) error {
+	tokenKey := cfg.ServerURL() + " " + cfg.Username
+	if token, ok := sessionTokens[tokenKey]; ok {
+		err := loginEx(client, cfg, "auth.login_ex", map[string]interface{}{
+			"mechanism": "TOKEN_PLAIN",
+			"token":     token,
+		})
+		if err == nil {
+			log.Printf("successfully logged in as %s with a session token", cfg.Username)
+			return nil
+		}
+		log.Printf("session token login failed, falling back to the password, %v", err)
+		delete(sessionTokens, tokenKey)
+	}
+
+	err := loginEx(client, cfg, "auth.login_ex", map[string]interface{}{
+		"mechanism": "PASSWORD_PLAIN",
+		"username":  cfg.Username,
+		"password":  cfg.Password,
+	})
+	if err != nil {
+		return fmt.Errorf("login failed, %v", err)
+	}
+	log.Printf("successfully logged in as %s", cfg.Username)
+
+	if cfg.GenerateToken {
+		token, err := generateToken(client, cfg)
+		if err != nil {
+			return err
+		}
+		sessionTokens[tokenKey] = token
+		log.Printf("generated a session token valid for %d seconds", cfg.TokenTTL)
+	}
+	return nil
+}
+
+// call an auth.login_ex method and follow an OTP challenge
+func loginEx(client Client, cfg *config.Config, method string, params map[string]interface{}) error {
+	resp, err := client.Call(method, cfg.TimeoutSeconds, []interface{}{params})
+	if err != nil {
+		return err
+	}
+	if cfg.Debug {
+		log.Printf("%s response type: %s", method, responseType(resp))
+	}
+	var response LoginExResponse
+	if err = json.Unmarshal(resp, &response); err != nil {
+		return fmt.Errorf("could not parse the %s response, %v", method, err)
+	}
+	if response.Error != nil {
+		return fmt.Errorf("%s failed, %s", method, response.Error.Message)
+	}
+
+	switch response.Result.ResponseType {
+	case loginSuccess:
+		return nil
+	case loginOtpRequired:
+		if cfg.OtpSecret == "" {
+			return fmt.Errorf("%s requires a one-time password, define otp_secret_file", cfg.Username)
+		}
+		code, err := totp(cfg.OtpSecret, time.Now())
+		if err != nil {
+			return err
+		}
+		return loginEx(client, cfg, "auth.login_ex_continue", map[string]interface{}{
+			"mechanism": "OTP_TOKEN",
+			"otp_token": code,
+		})
+	case loginAuthErr:
+		return fmt.Errorf("invalid credentials for %s", cfg.Username)
+	case loginExpired:
+		return fmt.Errorf("the credentials for %s have expired", cfg.Username)
+	default:
+		return fmt.Errorf("unexpected %s response %s", method, response.Result.ResponseType)
+	}
+}
+
+// ask TrueNAS for a reusable token bound to this client's origin
+func generateToken(client Client, cfg *config.Config) (string, error) {
+	params := []interface{}{cfg.TokenTTL, map[string]interface{}{}, true, false}
+	resp, err := client.Call("auth.generate_token", cfg.TimeoutSeconds, params)
+	if err != nil {
+		return "", fmt.Errorf("generating a session token failed, %v", err)
+	}
+	var response GenerateTokenResponse
+	if err = json.Unmarshal(resp, &response); err != nil {
+		return "", fmt.Errorf("could not parse the auth.generate_token response, %v", err)
+	}
+	if response.Error != nil {
+		return "", fmt.Errorf("generating a session token failed, %s", response.Error.Message)
+	}
+	if response.Result == "" {
+		return "", fmt.Errorf("generating a session token failed, no token in the response")
+	}
+	return response.Result, nil
+}
+
+// the response type alone, login responses must not be logged in full
+func responseType(resp json.RawMessage) string {
+	var response LoginExResponse
+	if err := json.Unmarshal(resp, &response); err != nil || response.Result.ResponseType == "" {
+		return "unknown"
+	}
+	return response.Result.ResponseType
+}
+
+// RFC 6238 time-based one-time password, 6 digits, 30 second steps
+func totp(secret string, now time.Time) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return "", fmt.Errorf("invalid otp secret, %v", err)
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(now.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000), nil
+}
@@ -26,15 +26,47 @@ import (
 	"errors"
 	"fmt"
 	"github.com/truenas/api_client_golang/truenas_api"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 	"tnascert-deploy/config"
 )
 
+// the extra connections of the app inventory share the state of the mock
+// they are added to
+func init() {
+	newConnection = func(client Client, cfg *config.Config) (Client, error) {
+		c := client.(*DeployClient)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.connections++
+		return c, nil
+	}
+}
+
 // mock client for tests
 type DeployClient struct {
-	url           string // WebSocket server URL
-	tlsSkipVerify bool   // WebSocket connection instance
-	cfg           *config.Config
+	url            string // WebSocket server URL
+	tlsSkipVerify  bool   // WebSocket connection instance
+	cfg            *config.Config
+	passwordLogins int                               // auth.login_ex calls with the password mechanism
+	roles          []string                          // roles reported by auth.me, FULL_ADMIN if nil
+	apps           []string                          // apps reported by app.query, testapp if nil
+	failApps       []string                          // apps whose app.update fails
+	updatedApps    []string                          // apps passed to app.update
+	appCerts       map[string]int64                  // network.certificate_id reported by app.config
+	appValues      map[string]map[string]interface{} // values reported by app.config in place of the defaults
+	appUpdates     map[string]interface{}            // values passed to app.update
+	appStates      map[string]string                 // app states reported by app.query, RUNNING if not set
+	calls          map[string]int                    // the number of calls of each method
+	services       map[string]map[string]interface{} // the configs of the services by namespace
+	failUpdates    []string                          // namespaces whose update is ignored
+	cas            map[string]int64                  // certificate authorities by name
+	chowned        []string                          // paths passed to filesystem.chown
+	restarted      []string                          // apps passed to app.restart or app.redeploy
+	connections    int                               // extra connections opened by the app inventory
+	mu             sync.Mutex                        // Call is used by the extra connections at the same time
 }
 
 func NewClient(serverURL string, TlsSkipVerify bool) (*DeployClient, error) {
@@ -44,14 +76,28 @@ func NewClient(serverURL string, TlsSkipVerify bool) (*DeployClient, error) {
 }
 
 func (c *DeployClient) Call(method string, timeout int64, params interface{}) (json.RawMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.calls == nil {
+		c.calls = map[string]int{}
+	}
+	c.calls[method]++
 	if method == "app.config" {
 		var resp json.RawMessage
+		name := params.([]interface{})[0].(string)
+		if values, ok := c.appValues[name]; ok {
+			return json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "result": values})
+		}
+		network := map[string]interface{}{}
+		if id, ok := c.appCerts[name]; ok {
+			network["certificate_id"] = id
+		}
 		data := map[string]interface{}{
 			"jsonrpc": "2.0",
 			"id":      1,
 			"result": map[string]interface{}{"ix_certificates": map[string]interface{}{
 				"testcert": 100,
-			}, "network": map[string]interface{}{}},
+			}, "network": network},
 		}
 		res, err := json.Marshal(data)
 		if err != nil {
@@ -62,7 +108,26 @@ func (c *DeployClient) Call(method string, timeout int64, params interface{}) (j
 		}
 	} else if method == "app.query" {
 		var resp json.RawMessage
-		m := []map[string]interface{}{{"name": "testapp", "id": "testapp"}}
+		names := []string{"testapp"}
+		if c.apps != nil {
+			names = c.apps
+		}
+		// a name filter, [[["name", "=", name]]]
+		filter := ""
+		if args, ok := params.([]interface{}); ok && len(args) > 0 {
+			filter = args[0].([]interface{})[0].([]interface{})[2].(string)
+		}
+		var m []map[string]interface{}
+		for _, name := range names {
+			if filter != "" && name != filter {
+				continue
+			}
+			state, ok := c.appStates[name]
+			if !ok {
+				state = "RUNNING"
+			}
+			m = append(m, map[string]interface{}{"name": name, "id": name, "state": state})
+		}
 		data := map[string]interface{}{
 			"jsonrpc": "2.0",
 			"id":      1,
@@ -110,26 +175,88 @@ func (c *DeployClient) Call(method string, timeout int64, params interface{}) (j
 			resp = json.RawMessage(res)
 			return resp, nil
 		}
-	} else if method == "ftp.update" {
-		result := map[string]interface{}{
-			"testresult": "ok",
+	} else if method == "auth.login_ex" || method == "auth.login_ex_continue" {
+		return c.loginEx(method, params.([]interface{})[0].(map[string]interface{}))
+	} else if method == "auth.generate_token" {
+		return json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "result": "session-token"})
+	} else if method == "auth.me" {
+		roles := c.roles
+		if roles == nil {
+			roles = []string{"FULL_ADMIN"}
 		}
-		args := map[string]interface{}{
-			"jsonrpc": "2.0",
-			"id":      1,
-			"result":  result,
+		return json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "result": map[string]interface{}{
+			"pw_name": "certbot", "privilege": map[string]interface{}{"roles": map[string]interface{}{"$set": roles}, "allowlist": []interface{}{}},
+		}})
+	} else if method == "user.query" || method == "group.query" {
+		// www-data is the only account
+		name := params.([]interface{})[0].([]interface{})[0].([]interface{})[2].(string)
+		var accounts []map[string]interface{}
+		if name == "www-data" {
+			accounts = append(accounts, map[string]interface{}{"username": name, "group": name, "uid": 33, "gid": 33})
 		}
-		res, err := json.Marshal(args)
-		if err != nil {
-			return res, fmt.Errorf("mock.Call(): Error marshalling response: %v", err)
-		} else {
-			resp := json.RawMessage(res)
-			return resp, nil
+		return json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "result": accounts})
+	} else if method == "core.get_jobs" {
+		id := params.([]interface{})[0].([]interface{})[0].([]interface{})[2]
+		return json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "result": []interface{}{
+			map[string]interface{}{"id": id, "state": "SUCCESS"},
+		}})
+	} else if method == "core.download" {
+		path := params.([]interface{})[1].([]interface{})[0].(string)
+		return json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "result": []interface{}{
+			1, "/_download/1?path=" + url.QueryEscape(path),
+		}})
+	} else if method == "certificateauthority.query" {
+		name := params.([]interface{})[0].([]interface{})[0].([]interface{})[2].(string)
+		var cas []map[string]interface{}
+		if id, ok := c.cas[name]; ok {
+			cas = append(cas, map[string]interface{}{"id": id, "name": name})
+		}
+		return json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "result": cas})
+	} else if method == "certificateauthority.create" {
+		if c.cas == nil {
+			c.cas = map[string]int64{}
 		}
+		name := params.([]interface{})[0].(map[string]interface{})["name"].(string)
+		c.cas[name] = int64(10 + len(c.cas))
+		return json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "result": map[string]interface{}{"id": c.cas[name], "name": name}})
+	} else if namespace, ok := strings.CutSuffix(method, ".config"); ok {
+		return json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "result": c.service(namespace)})
+	} else if namespace, ok := strings.CutSuffix(method, ".update"); ok {
+		c.updateService(namespace, params)
+		return json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "result": c.service(namespace)})
 	}
 	return nil, nil
 }
 
+// the config of a service, set by its update
+func (c *DeployClient) service(namespace string) map[string]interface{} {
+	if c.services == nil {
+		c.services = map[string]map[string]interface{}{
+			"system.general": {"ui_certificate": map[string]interface{}{"id": 1, "name": "truenas_default"}},
+			"ftp":            {"tls": true, "ssltls_certificate": 2},
+		}
+	}
+	if _, ok := c.services[namespace]; !ok {
+		c.services[namespace] = map[string]interface{}{}
+	}
+	return c.services[namespace]
+}
+
+func (c *DeployClient) updateService(namespace string, params interface{}) {
+	for _, failed := range c.failUpdates {
+		if namespace == failed {
+			return
+		}
+	}
+	var args []map[string]interface{}
+	data, _ := json.Marshal(params)
+	json.Unmarshal(data, &args)
+	service := c.service(namespace)
+	for key, value := range args[0] {
+		service[key] = value
+	}
+}
+
 func jobRunner(job *truenas_api.Job) {
 	time.Sleep(2 * time.Second)
 	job.ProgressCh <- 100
@@ -142,6 +269,17 @@ func jobRunner(job *truenas_api.Job) {
 func (c *DeployClient) CallWithJob(method string, params interface{}, callback func(progress float64, state string, desc string)) (*truenas_api.Job, error) {
 	var job truenas_api.Job
 	if method == "app.update" {
+		name := params.([]interface{})[0].(string)
+		for _, failed := range c.failApps {
+			if name == failed {
+				return nil, errors.New("mock app.update failed")
+			}
+		}
+		c.updatedApps = append(c.updatedApps, name)
+		if c.appUpdates == nil {
+			c.appUpdates = map[string]interface{}{}
+		}
+		c.appUpdates[name] = params.([]interface{})[1].(map[string]interface{})["values"]
 		job = truenas_api.Job{
 			ID:         100,
 			Method:     "app.update",
@@ -149,6 +287,42 @@ func (c *DeployClient) CallWithJob(method string, params interface{}, callback f
 			ProgressCh: make(chan float64),
 			DoneCh:     make(chan string),
 		}
+	} else if method == "app.start" {
+		c.appStates[params.([]interface{})[0].(string)] = "RUNNING"
+		job = truenas_api.Job{
+			ID:         102,
+			Method:     "app.start",
+			State:      "PENDING",
+			ProgressCh: make(chan float64),
+			DoneCh:     make(chan string),
+		}
+	} else if method == "filesystem.chown" {
+		c.chowned = append(c.chowned, params.([]interface{})[0].(map[string]interface{})["path"].(string))
+		job = truenas_api.Job{
+			ID:         103,
+			Method:     method,
+			State:      "PENDING",
+			ProgressCh: make(chan float64),
+			DoneCh:     make(chan string),
+		}
+	} else if method == "app.restart" || method == "app.redeploy" {
+		c.restarted = append(c.restarted, params.([]interface{})[0].(string))
+		job = truenas_api.Job{
+			ID:         104,
+			Method:     method,
+			State:      "PENDING",
+			ProgressCh: make(chan float64),
+			DoneCh:     make(chan string),
+		}
+	} else if namespace, ok := strings.CutSuffix(method, ".update"); ok {
+		c.updateService(namespace, params)
+		job = truenas_api.Job{
+			ID:         105,
+			Method:     method,
+			State:      "PENDING",
+			ProgressCh: make(chan float64),
+			DoneCh:     make(chan string),
+		}
 	} else if method == "certificate.create" {
 		job = truenas_api.Job{
 			ID:         101,
@@ -183,6 +357,36 @@ func (c *DeployClient) Login(username string, password string, apiKey string) er
 	return errors.New("mock.Client Login: invalid api key")
 }
 
+// accepts admin/secret, challenging for an OTP when the config has a secret,
+// and the token returned by auth.generate_token
+func (c *DeployClient) loginEx(method string, params map[string]interface{}) (json.RawMessage, error) {
+	responseType := "AUTH_ERR"
+	switch params["mechanism"] {
+	case "PASSWORD_PLAIN":
+		c.passwordLogins++
+		if params["username"] == "admin" && params["password"] == "secret" {
+			responseType = "SUCCESS"
+			if c.cfg.OtpSecret != "" {
+				responseType = "OTP_REQUIRED"
+			}
+		}
+	case "OTP_TOKEN":
+		code, _ := totp(c.cfg.OtpSecret, time.Now())
+		if method == "auth.login_ex_continue" && params["otp_token"] == code {
+			responseType = "SUCCESS"
+		}
+	case "TOKEN_PLAIN":
+		if params["token"] == "session-token" {
+			responseType = "SUCCESS"
+		}
+	}
+	return json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"result":  map[string]interface{}{"response_type": responseType},
+	})
+}
+
 func (c *DeployClient) SetConfig(cfg *config.Config) {
 	c.cfg = cfg
 }
@@ -190,3 +394,29 @@ func (c *DeployClient) SetConfig(cfg *config.Config) {
 func (c *DeployClient) SubscribeToJobs() error {
 	return nil
 }
+
+// in memory files for the file targets
+type memFileStore struct {
+	files  map[string][]byte
+	modes  map[string]uint32
+	writes int
+}
+
+func newMemFileStore() *memFileStore {
+	return &memFileStore{files: map[string][]byte{}, modes: map[string]uint32{}}
+}
+
+func (s *memFileStore) ReadFile(path string) ([]byte, error) {
+	data, ok := s.files[path]
+	if !ok {
+		return nil, fmt.Errorf("%s does not exist", path)
+	}
+	return data, nil
+}
+
+func (s *memFileStore) WriteFile(path string, data []byte, mode uint32) error {
+	s.files[path] = data
+	s.modes[path] = mode
+	s.writes++
+	return nil
+}
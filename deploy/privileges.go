@@ -0,0 +1,156 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package deploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"tnascert-deploy/config"
+)
+
+// Privilege is a TrueNAS role needed by the configured actions
+type Privilege struct {
+	Role    string `json:"role"`
+	Reason  string `json:"reason"`
+	Granted bool   `json:"granted"`
+}
+
+type AuthMeResponse struct {
+	JsonRPC string `json:"jsonrpc"`
+	ID      int    `json:"id"`
+	Result  struct {
+		Username  string `json:"pw_name"`
+		Privilege struct {
+			Roles     json.RawMessage `json:"roles"`
+			Allowlist []struct {
+				Method   string `json:"method"`
+				Resource string `json:"resource"`
+			} `json:"allowlist"`
+		} `json:"privilege"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// RequiredPrivileges lists the roles needed by the actions configured in the section
+func RequiredPrivileges(cfg *config.Config) []Privilege {
+	privileges := []Privilege{
+		{Role: "CERTIFICATE_WRITE", Reason: "create the certificate"},
+		{Role: "APPS_READ", Reason: "list the installed certificates"},
+	}
+	for _, name := range cfg.Bindings() {
+		if b, ok := registeredBindings[name]; ok {
+			privileges = append(privileges, Privilege{Role: b.Role(), Reason: "bind " + name})
+		}
+	}
+	if cfg.CaPath != "" {
+		privileges = append(privileges, Privilege{Role: "CERTIFICATE_AUTHORITY_WRITE", Reason: "ca_path"})
+	}
+	if len(cfg.Targets) > 0 {
+		privileges = append(privileges, Privilege{Role: "FILESYSTEM_DATA_WRITE", Reason: "file_targets"})
+	}
+	for _, t := range cfg.Targets {
+		if t.Owner != "" || t.Group != "" {
+			privileges = append(privileges, Privilege{Role: "FILESYSTEM_ATTRS_WRITE", Reason: "file target " + t.Name + " owner"})
+			break
+		}
+	}
+	for _, t := range cfg.Targets {
+		if t.RestartApp != "" && !cfg.Binds(config.BindApps) {
+			privileges = append(privileges, Privilege{Role: "APPS_WRITE", Reason: "file target " + t.Name + " restart_app"})
+			break
+		}
+	}
+	return privileges
+}
+
+// CheckPrivileges asks TrueNAS with auth.me which roles the logged in
+// credentials hold and marks each required privilege as granted or not. It
+// returns the user name reported by auth.me.
+func CheckPrivileges(client Client, cfg *config.Config) (string, []Privilege, error) {
+	resp, err := client.Call("auth.me", cfg.TimeoutSeconds, []interface{}{})
+	if err != nil {
+		return "", nil, fmt.Errorf("auth.me failed, %v", err)
+	}
+	var response AuthMeResponse
+	if err = json.Unmarshal(resp, &response); err != nil {
+		return "", nil, fmt.Errorf("could not parse the auth.me response, %v", err)
+	}
+	if response.Error != nil {
+		return "", nil, fmt.Errorf("auth.me failed, %s", response.Error.Message)
+	}
+
+	// a set is a plain list or, from older middleware, {"$set": [...]}
+	var roles []string
+	if err = json.Unmarshal(response.Result.Privilege.Roles, &roles); err != nil {
+		var set struct {
+			Set []string `json:"$set"`
+		}
+		if err = json.Unmarshal(response.Result.Privilege.Roles, &set); err != nil {
+			return "", nil, fmt.Errorf("could not parse the roles in the auth.me response, %v", err)
+		}
+		roles = set.Set
+	}
+	held := map[string]bool{}
+	for _, role := range roles {
+		held[role] = true
+	}
+	for _, entry := range response.Result.Privilege.Allowlist {
+		if entry.Method == "*" && entry.Resource == "*" {
+			held["FULL_ADMIN"] = true
+		}
+	}
+
+	privileges := RequiredPrivileges(cfg)
+	for i := range privileges {
+		privileges[i].Granted = hasRole(held, privileges[i].Role)
+	}
+	return response.Result.Username, privileges, nil
+}
+
+// MissingPrivileges returns an error listing the privileges not granted
+func MissingPrivileges(privileges []Privilege) error {
+	var missing []string
+	for _, p := range privileges {
+		if !p.Granted {
+			missing = append(missing, fmt.Sprintf("%s (%s)", p.Role, p.Reason))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the credentials are missing the privileges: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// whether the held roles grant a role, directly or through a broader role
+func hasRole(held map[string]bool, role string) bool {
+	if held[role] || held["FULL_ADMIN"] {
+		return true
+	}
+	if base, ok := strings.CutSuffix(role, "_READ"); ok {
+		if held[base+"_WRITE"] || held["READONLY_ADMIN"] {
+			return true
+		}
+	}
+	if strings.HasPrefix(role, "SHARING_") && (held["SHARING_ADMIN"] || held["SHARING_MANAGER"]) {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,408 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/pborman/getopt/v2"
+	"github.com/truenas/api_client_golang/truenas_api"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"tnascert-deploy/certsource"
+	"tnascert-deploy/config"
+	"tnascert-deploy/deploy"
+	"tnascert-deploy/vault"
+)
+
+// doctor stage results
+const (
+	stageOK      = "ok"
+	stageWarning = "warning"
+	stageFailed  = "failed"
+	stageSkipped = "skipped"
+)
+
+// clock skew beyond this is reported as a warning
+const maxClockSkew = 30 * time.Second
+
+// doctorStage is the result of one doctor check
+type doctorStage struct {
+	Name       string             `json:"name"`
+	Status     string             `json:"status"`
+	Detail     string             `json:"detail,omitempty"`
+	Error      string             `json:"error,omitempty"`
+	Privileges []deploy.Privilege `json:"privileges,omitempty"`
+}
+
+// doctorReport is the result of every doctor check for a config section
+type doctorReport struct {
+	Section string         `json:"section"`
+	OK      bool           `json:"ok"`
+	Stages  []*doctorStage `json:"stages"`
+}
+
+func (r *doctorReport) add(name string) *doctorStage {
+	stage := &doctorStage{Name: name, Status: stageSkipped}
+	r.Stages = append(r.Stages, stage)
+	return stage
+}
+
+func (s *doctorStage) ok(format string, args ...interface{}) {
+	s.Status, s.Detail = stageOK, fmt.Sprintf(format, args...)
+}
+
+func (s *doctorStage) fail(err error) {
+	s.Status, s.Error = stageFailed, err.Error()
+}
+
+// the doctor command: check each stage of a deployment, from parsing the
+// config section to logging in, without changing anything on TrueNAS
+func runDoctor(args []string, configFile string, opts config.Options) error {
+	set := getopt.New()
+	asJSON := set.BoolLong("json", 'j', "print the report as JSON")
+	set.SetParameters("[ini_section_name]")
+	set.SetProgram("doctor")
+	if err := set.Getopt(append([]string{"doctor"}, args...), nil); err != nil {
+		set.PrintUsage(os.Stderr)
+		return err
+	}
+	section := config.Default_section
+	if set.NArgs() > 0 {
+		section = set.Arg(0)
+	}
+
+	report := diagnose(configFile, section, opts)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		printReport(os.Stdout, report)
+	}
+	if !report.OK {
+		return fmt.Errorf("config section %s has failed checks", section)
+	}
+	return nil
+}
+
+func diagnose(configFile string, section string, opts config.Options) *doctorReport {
+	report := &doctorReport{Section: section}
+	defer func() {
+		report.OK = true
+		for _, stage := range report.Stages {
+			if stage.Status == stageFailed {
+				report.OK = false
+			}
+		}
+	}()
+
+	stage := report.add("config")
+	cfg, err := config.NewWithOptions(configFile, section, opts)
+	if err != nil {
+		stage.fail(err)
+		return report
+	}
+	stage.ok("loaded %s", configFile)
+
+	// vault is needed for both a vault certificate source and the api key
+	var vc *vault.Client
+	if cfg.UsesVault() {
+		stage = report.add("vault")
+		if vc, err = openVault(cfg); err != nil {
+			stage.fail(err)
+		} else {
+			defer closeVault(vc)
+			stage.ok("logged in to %s", cfg.VaultAddr)
+		}
+	}
+
+	checkCertificateFiles(report.add("certificate"), cfg, vc)
+
+	dns, tcp, tlsStage := report.add("dns"), report.add("tcp"), report.add("tls")
+	websocket, login, privileges := report.add("websocket"), report.add("login"), report.add("privileges")
+	version, clock := report.add("version"), report.add("clock")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.TimeoutSeconds)*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, cfg.ConnectHost)
+	if err != nil {
+		dns.fail(err)
+		return report
+	}
+	dns.ok("%s resolves to %s", cfg.ConnectHost, strings.Join(addrs, ", "))
+
+	address := net.JoinHostPort(cfg.ConnectHost, strconv.FormatUint(cfg.Port, 10))
+	dialer := &net.Dialer{Timeout: time.Duration(cfg.TimeoutSeconds) * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		tcp.fail(err)
+		return report
+	}
+	tcp.ok("connected to %s", conn.RemoteAddr())
+	if cfg.Protocol == config.WSS {
+		if !checkTLS(tlsStage, cfg, conn) {
+			return report
+		}
+	} else {
+		conn.Close()
+		tlsStage.Detail = "the protocol is ws"
+	}
+
+	client, err := truenas_api.NewClient(cfg.ServerURL(), !cfg.TlsSkipVerify)
+	if err != nil {
+		websocket.fail(err)
+		return report
+	}
+	defer func(client *truenas_api.Client) {
+		if err := client.Close(); err != nil {
+			log.Printf("failed to close the client connection, %v", err)
+		}
+	}(client)
+	websocket.ok("connected to %s", cfg.ServerURL())
+
+	if err = deploy.Login(client, cfg); err != nil {
+		login.fail(err)
+		return report
+	}
+	if cfg.Username != "" {
+		login.ok("logged in as %s", cfg.Username)
+	} else {
+		login.ok("logged in with the api key from %s", cfg.ApiKeySource())
+	}
+
+	user, granted, err := deploy.CheckPrivileges(client, cfg)
+	if err != nil {
+		privileges.fail(err)
+	} else {
+		privileges.Privileges = granted
+		if err = deploy.MissingPrivileges(granted); err != nil {
+			privileges.fail(err)
+		} else {
+			privileges.ok("%s holds the privileges needed for the configured actions", user)
+		}
+	}
+
+	checkVersion(version, client, cfg)
+	checkClock(clock, client, cfg)
+	return report
+}
+
+// load the certificate and key, unless the source would consume its input or
+// run a command
+func checkCertificateFiles(stage *doctorStage, cfg *config.Config, vc *vault.Client) {
+	kind, _, _ := strings.Cut(cfg.Source, ":")
+	switch kind {
+	case config.SourceStdin, config.SourceFD, config.SourceExec:
+		stage.Detail = fmt.Sprintf("the %s source is not read by doctor", kind)
+		return
+	case config.SourceVault:
+		if vc == nil {
+			return
+		}
+	}
+	source, err := certsource.New(cfg, vc, nil)
+	if err != nil {
+		stage.fail(err)
+		return
+	}
+	bundle, err := source.Load()
+	if err == nil {
+		err = bundle.Verify()
+	}
+	if err != nil {
+		stage.fail(err)
+		return
+	}
+	cert, err := leafCertificate(bundle.Certificate)
+	if err != nil {
+		stage.fail(err)
+		return
+	}
+	stage.ok("%s, %s", source, describeCertificate(cert))
+	if time.Now().After(cert.NotAfter) {
+		stage.Status = stageWarning
+		stage.Error = "the certificate has expired"
+	}
+}
+
+// handshake on the tcp connection, skipping verification so that the
+// certificate presented can always be reported, then verify it separately.
+// Returns false when the handshake itself failed.
+func checkTLS(stage *doctorStage, cfg *config.Config, conn net.Conn) bool {
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: cfg.ConnectHost, InsecureSkipVerify: true})
+	defer tlsConn.Close()
+	tlsConn.SetDeadline(time.Now().Add(time.Duration(cfg.TimeoutSeconds) * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		stage.fail(err)
+		return false
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		stage.fail(fmt.Errorf("no certificate presented"))
+		return false
+	}
+	leaf := state.PeerCertificates[0]
+	stage.ok("%s, %s", tls.VersionName(state.Version), describeCertificate(leaf))
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{DNSName: cfg.ConnectHost, Intermediates: intermediates})
+	if err != nil {
+		// with tls_skip_verify the deployment still connects
+		stage.Status = stageFailed
+		if cfg.TlsSkipVerify {
+			stage.Status = stageWarning
+		}
+		stage.Error = fmt.Sprintf("verification failed, %v", err)
+	}
+	return true
+}
+
+func checkVersion(stage *doctorStage, client deploy.Client, cfg *config.Config) {
+	resp, err := client.Call("system.version", cfg.TimeoutSeconds, []interface{}{})
+	if err != nil {
+		stage.fail(err)
+		return
+	}
+	var response struct {
+		Result string `json:"result"`
+	}
+	if err = json.Unmarshal(resp, &response); err != nil || response.Result == "" {
+		stage.fail(fmt.Errorf("could not parse the system.version response"))
+		return
+	}
+	stage.ok("%s", response.Result)
+}
+
+// the certificate dates are checked on TrueNAS, a skewed clock can make a
+// new certificate look not yet valid
+func checkClock(stage *doctorStage, client deploy.Client, cfg *config.Config) {
+	before := time.Now()
+	resp, err := client.Call("system.info", cfg.TimeoutSeconds, []interface{}{})
+	if err != nil {
+		stage.fail(err)
+		return
+	}
+	local := before.Add(time.Since(before) / 2)
+	var response struct {
+		Result struct {
+			Datetime json.RawMessage `json:"datetime"`
+		} `json:"result"`
+	}
+	if err = json.Unmarshal(resp, &response); err != nil {
+		stage.fail(fmt.Errorf("could not parse the system.info response, %v", err))
+		return
+	}
+	remote, err := parseDatetime(response.Result.Datetime)
+	if err != nil {
+		stage.fail(err)
+		return
+	}
+	skew := remote.Sub(local).Round(time.Second)
+	stage.ok("TrueNAS clock differs by %s", skew)
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		stage.Status = stageWarning
+		stage.Error = fmt.Sprintf("the clock skew is more than %s", maxClockSkew)
+	}
+}
+
+// a datetime is {"$date": milliseconds} from the middleware, or a timestamp string
+func parseDatetime(data json.RawMessage) (time.Time, error) {
+	var date struct {
+		Millis int64 `json:"$date"`
+	}
+	if err := json.Unmarshal(data, &date); err == nil && date.Millis != 0 {
+		return time.UnixMilli(date.Millis), nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		return time.Parse(time.RFC3339, s)
+	}
+	return time.Time{}, fmt.Errorf("could not parse the datetime %s", data)
+}
+
+// the first certificate of a pem chain
+func leafCertificate(certPem []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, certPem = pem.Decode(certPem)
+		if block == nil {
+			return nil, fmt.Errorf("no certificate found")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+func describeCertificate(cert *x509.Certificate) string {
+	desc := fmt.Sprintf("subject %s, issuer %s, expires %s", cert.Subject.CommonName, cert.Issuer.CommonName, cert.NotAfter.Format(time.RFC3339))
+	if len(cert.DNSNames) > 0 {
+		desc += ", names " + strings.Join(cert.DNSNames, " ")
+	}
+	return desc
+}
+
+func printReport(w io.Writer, report *doctorReport) {
+	fmt.Fprintf(w, "config section %s\n\n", report.Section)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, stage := range report.Stages {
+		switch {
+		case stage.Detail == "":
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", stage.Status, stage.Name, stage.Error)
+		case stage.Error == "":
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", stage.Status, stage.Name, stage.Detail)
+		default:
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n  \t\t%s\n", stage.Status, stage.Name, stage.Detail, stage.Error)
+		}
+	}
+	tw.Flush()
+	for _, stage := range report.Stages {
+		if len(stage.Privileges) > 0 {
+			fmt.Fprintln(w)
+			printPrivileges(w, stage.Privileges)
+		}
+	}
+}
+
+func printPrivileges(w io.Writer, privileges []deploy.Privilege) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, p := range privileges {
+		status := "ok"
+		if !p.Granted {
+			status = "missing"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", status, p.Role, p.Reason)
+	}
+	tw.Flush()
+}
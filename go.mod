@@ -3,13 +3,20 @@ module tnascert-deploy
 go 1.24
 
 require (
+	filippo.io/age v1.2.1
+	github.com/BurntSushi/toml v1.4.0
 	github.com/ncruces/go-strftime v0.1.9
 	github.com/pborman/getopt/v2 v2.1.0
 	github.com/truenas/api_client_golang v0.0.0-20250418135347-880b20d42445
+	golang.org/x/term v0.21.0
 	gopkg.in/ini.v1 v1.67.0
+	gopkg.in/yaml.v3 v3.0.1
+	software.sslmate.com/src/go-pkcs12 v0.4.0
 )
 
 require (
 	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/stretchr/testify v1.10.0 // indirect
+	golang.org/x/crypto v0.24.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
 )
@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/*
+ * Renewal hook support for certbot --deploy-hook and acme.sh --reloadcmd.
+ */
+
+package hook
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"tnascert-deploy/config"
+)
+
+const (
+	Certbot = "certbot"
+	AcmeSh  = "acme.sh"
+)
+
+// Renewal describes a renewed certificate as reported by the ACME client
+type Renewal struct {
+	Client        string   // the ACME client that ran the hook
+	Lineage       string   // certbot RENEWED_LINEAGE, the live/ directory of the certificate
+	Domains       []string // renewed domain names
+	CertPath      string   // acme.sh CERT_PATH
+	KeyPath       string   // acme.sh CERT_KEY_PATH
+	FullChainPath string   // acme.sh CERT_FULLCHAIN_PATH
+}
+
+// FromEnv builds a Renewal from the environment variables set by certbot or acme.sh
+func FromEnv(getenv func(string) string) (*Renewal, error) {
+	if lineage := getenv("RENEWED_LINEAGE"); lineage != "" {
+		return &Renewal{
+			Client:  Certbot,
+			Lineage: cleanPath(lineage),
+			Domains: strings.Fields(getenv("RENEWED_DOMAINS")),
+		}, nil
+	}
+
+	r := &Renewal{
+		Client:        AcmeSh,
+		CertPath:      cleanPath(getenv("CERT_PATH")),
+		KeyPath:       cleanPath(getenv("CERT_KEY_PATH")),
+		FullChainPath: cleanPath(getenv("CERT_FULLCHAIN_PATH")),
+	}
+	if domain := getenv("Le_Domain"); domain != "" {
+		r.Domains = []string{domain}
+	}
+	if r.CertPath == "" && r.KeyPath == "" && r.FullChainPath == "" {
+		return nil, fmt.Errorf("no renewal found in the environment, expected RENEWED_LINEAGE from certbot or CERT_PATH, CERT_KEY_PATH and CERT_FULLCHAIN_PATH from acme.sh")
+	}
+	return r, nil
+}
+
+// Matches reports whether a config section deploys the renewed certificate,
+// either by its certificate and key paths or by its configured domains. The
+// paths on both sides are compared after resolving symlinks, so a section
+// that names /etc/letsencrypt through a symlinked directory still matches.
+func (r *Renewal) Matches(cfg *config.Config) bool {
+	paths := []string{cleanPath(cfg.FullChainPath), cleanPath(cfg.Private_key_path)}
+	lineage := resolvePath(r.Lineage)
+	renewed := []string{resolvePath(r.CertPath), resolvePath(r.KeyPath), resolvePath(r.FullChainPath)}
+
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		// the live/ files link into archive/, so compare the directory
+		if lineage != "" && resolvePath(filepath.Dir(p)) == lineage {
+			return true
+		}
+		resolved := resolvePath(p)
+		for _, want := range renewed {
+			if want != "" && resolved == want {
+				return true
+			}
+		}
+	}
+
+	for _, want := range cfg.Domains {
+		for _, domain := range r.Domains {
+			if strings.EqualFold(want, domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *Renewal) String() string {
+	if r.Client == Certbot {
+		return fmt.Sprintf("certbot lineage %s (%s)", r.Lineage, strings.Join(r.Domains, " "))
+	}
+	return fmt.Sprintf("acme.sh certificate %s", r.FullChainPath)
+}
+
+// cleanPath returns an absolute, cleaned path so that relative config paths
+// compare equal to the absolute paths exported by the ACME clients
+func cleanPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// resolvePath follows any symlinks in path, a path that cannot be resolved,
+// such as one that does not exist yet, is compared as it is
+func resolvePath(path string) string {
+	if path == "" {
+		return ""
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return path
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package hook
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"tnascert-deploy/config"
+)
+
+func env(vars map[string]string) func(string) string {
+	return func(key string) string {
+		return vars[key]
+	}
+}
+
+func TestCertbotRenewal(t *testing.T) {
+	renewal, err := FromEnv(env(map[string]string{
+		"RENEWED_LINEAGE": "/etc/letsencrypt/live/nas01.mydomain.com/",
+		"RENEWED_DOMAINS": "nas01.mydomain.com www.mydomain.com",
+	}))
+	if err != nil {
+		t.Fatalf("FromEnv failed with error: %v", err)
+	}
+	if renewal.Client != Certbot {
+		t.Errorf("Client should be %s", Certbot)
+	}
+
+	byPath := &config.Config{
+		FullChainPath:    "/etc/letsencrypt/live/nas01.mydomain.com/fullchain.pem",
+		Private_key_path: "/etc/letsencrypt/live/nas01.mydomain.com/privkey.pem",
+	}
+	if !renewal.Matches(byPath) {
+		t.Errorf("section with paths in the lineage should match")
+	}
+
+	byDomain := &config.Config{
+		FullChainPath:    "/srv/certs/fullchain.pem",
+		Private_key_path: "/srv/certs/privkey.pem",
+		Domains:          []string{"WWW.mydomain.com"},
+	}
+	if !renewal.Matches(byDomain) {
+		t.Errorf("section with a renewed domain should match")
+	}
+
+	other := &config.Config{
+		FullChainPath:    "/etc/letsencrypt/live/nas02.mydomain.com/fullchain.pem",
+		Private_key_path: "/etc/letsencrypt/live/nas02.mydomain.com/privkey.pem",
+		Domains:          []string{"nas02.mydomain.com"},
+	}
+	if renewal.Matches(other) {
+		t.Errorf("section for another lineage should not match")
+	}
+}
+
+func TestAcmeShRenewal(t *testing.T) {
+	renewal, err := FromEnv(env(map[string]string{
+		"CERT_PATH":           "/root/.acme.sh/nas01.mydomain.com/nas01.mydomain.com.cer",
+		"CERT_KEY_PATH":       "/root/.acme.sh/nas01.mydomain.com/nas01.mydomain.com.key",
+		"CERT_FULLCHAIN_PATH": "/root/.acme.sh/nas01.mydomain.com/fullchain.cer",
+	}))
+	if err != nil {
+		t.Fatalf("FromEnv failed with error: %v", err)
+	}
+	if renewal.Client != AcmeSh {
+		t.Errorf("Client should be %s", AcmeSh)
+	}
+
+	cfg := &config.Config{
+		FullChainPath:    "/root/.acme.sh/nas01.mydomain.com/fullchain.cer",
+		Private_key_path: "/root/.acme.sh/nas01.mydomain.com/nas01.mydomain.com.key",
+	}
+	if !renewal.Matches(cfg) {
+		t.Errorf("section with the acme.sh paths should match")
+	}
+	cfg.FullChainPath = "/root/.acme.sh/nas02.mydomain.com/fullchain.cer"
+	cfg.Private_key_path = "/root/.acme.sh/nas02.mydomain.com/nas02.mydomain.com.key"
+	if renewal.Matches(cfg) {
+		t.Errorf("section with other acme.sh paths should not match")
+	}
+
+	// no renewal variables at all
+	if _, err = FromEnv(env(map[string]string{})); err == nil {
+		t.Errorf("FromEnv should fail without renewal variables")
+	}
+}
+
+// a section may name the certificate through a symlink to the letsencrypt
+// directory, or the renewed paths may be the symlinks
+func TestSymlinkedRenewal(t *testing.T) {
+	dir := t.TempDir()
+	live := filepath.Join(dir, "letsencrypt", "live", "nas01.mydomain.com")
+	archive := filepath.Join(dir, "letsencrypt", "archive", "nas01.mydomain.com")
+	for _, d := range []string{live, archive} {
+		if err := os.MkdirAll(d, 0o700); err != nil {
+			t.Fatalf("mkdir failed with error: %v", err)
+		}
+	}
+	for _, name := range []string{"fullchain", "privkey"} {
+		if err := os.WriteFile(filepath.Join(archive, name+"1.pem"), nil, 0o600); err != nil {
+			t.Fatalf("writing %s failed with error: %v", name, err)
+		}
+		if err := os.Symlink(filepath.Join(archive, name+"1.pem"), filepath.Join(live, name+".pem")); err != nil {
+			t.Fatalf("symlink failed with error: %v", err)
+		}
+	}
+	linked := filepath.Join(dir, "certs")
+	if err := os.Symlink(filepath.Join(dir, "letsencrypt"), linked); err != nil {
+		t.Fatalf("symlink failed with error: %v", err)
+	}
+
+	renewal, err := FromEnv(env(map[string]string{"RENEWED_LINEAGE": live}))
+	if err != nil {
+		t.Fatalf("FromEnv failed with error: %v", err)
+	}
+	cfg := &config.Config{
+		FullChainPath:    filepath.Join(linked, "live", "nas01.mydomain.com", "fullchain.pem"),
+		Private_key_path: filepath.Join(linked, "live", "nas01.mydomain.com", "privkey.pem"),
+	}
+	if !renewal.Matches(cfg) {
+		t.Errorf("section with paths through a symlinked directory should match the lineage")
+	}
+
+	renewal, err = FromEnv(env(map[string]string{
+		"CERT_PATH":           filepath.Join(linked, "live", "nas01.mydomain.com", "fullchain.pem"),
+		"CERT_KEY_PATH":       filepath.Join(linked, "live", "nas01.mydomain.com", "privkey.pem"),
+		"CERT_FULLCHAIN_PATH": filepath.Join(linked, "live", "nas01.mydomain.com", "fullchain.pem"),
+	}))
+	if err != nil {
+		t.Fatalf("FromEnv failed with error: %v", err)
+	}
+	cfg = &config.Config{
+		FullChainPath:    filepath.Join(archive, "fullchain1.pem"),
+		Private_key_path: filepath.Join(archive, "privkey1.pem"),
+	}
+	if !renewal.Matches(cfg) {
+		t.Errorf("section with the resolved paths should match symlinked acme.sh paths")
+	}
+}
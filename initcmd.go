@@ -0,0 +1,430 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/pborman/getopt/v2"
+	"github.com/truenas/api_client_golang/truenas_api"
+	"golang.org/x/term"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"tnascert-deploy/config"
+	"tnascert-deploy/deploy"
+)
+
+// a config section built by the init wizard, settings are kept in the order asked
+type initSection struct {
+	name     string
+	settings [][2]string
+}
+
+func (s *initSection) set(key string, value string) {
+	for i := range s.settings {
+		if s.settings[i][0] == key {
+			s.settings[i][1] = value
+			return
+		}
+	}
+	s.settings = append(s.settings, [2]string{key, value})
+}
+
+func (s *initSection) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s]\n", s.name)
+	for _, kv := range s.settings {
+		fmt.Fprintf(&b, "%s = %s\n", kv[0], kv[1])
+	}
+	return b.String()
+}
+
+// reads answers from the terminal, offering a default for each question
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+	fd  int // terminal file descriptor for reading secrets without echo, -1 if none
+}
+
+func newPrompter(in *os.File, out io.Writer) *prompter {
+	fd := int(in.Fd())
+	if !term.IsTerminal(fd) {
+		fd = -1
+	}
+	return &prompter{in: bufio.NewReader(in), out: out, fd: fd}
+}
+
+func (p *prompter) line() (string, error) {
+	answer, err := p.in.ReadString('\n')
+	if err != nil && (err != io.EOF || answer == "") {
+		return "", err
+	}
+	return strings.TrimSpace(answer), nil
+}
+
+func (p *prompter) ask(question string, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+	answer, err := p.line()
+	if err != nil {
+		return "", err
+	}
+	if answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+func (p *prompter) confirm(question string, def bool) (bool, error) {
+	choices := "y/N"
+	if def {
+		choices = "Y/n"
+	}
+	fmt.Fprintf(p.out, "%s [%s]: ", question, choices)
+	answer, err := p.line()
+	if err != nil {
+		return false, err
+	}
+	switch strings.ToLower(answer) {
+	case "":
+		return def, nil
+	case "y", "yes":
+		return true, nil
+	case "n", "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("please answer yes or no")
+}
+
+func (p *prompter) secret(question string) (string, error) {
+	fmt.Fprintf(p.out, "%s: ", question)
+	if p.fd < 0 {
+		return p.line()
+	}
+	data, err := term.ReadPassword(p.fd)
+	fmt.Fprintln(p.out)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// askSecretFile asks for the path of a file holding a secret, creating it
+// readable by the owner only from a secret typed at the prompt when missing
+func (p *prompter) askSecretFile(question string, def string, what string) (string, error) {
+	path, err := p.ask(question, def)
+	if err != nil {
+		return "", err
+	}
+	if _, err = os.Stat(path); err == nil {
+		return path, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	secret, err := p.secret(what)
+	if err != nil {
+		return "", err
+	}
+	if secret == "" {
+		return "", fmt.Errorf("no %s given", what)
+	}
+	if err = os.WriteFile(path, []byte(secret+"\n"), 0o600); err != nil {
+		return "", fmt.Errorf("could not write %s, %v", path, err)
+	}
+	fmt.Fprintf(p.out, "wrote the %s to %s\n", what, path)
+	return path, nil
+}
+
+// the init wizard: ask for the connection settings and credentials, test
+// them, discover the services that can use a certificate and append the
+// validated section to the config file
+func runInit(args []string, configFile string, opts config.Options) error {
+	set := getopt.New()
+	host := set.StringLong("host", 'H', "", "TrueNAS hostname")
+	name := set.StringLong("section", 's', "", "name of the config section, defaults to the first label of the hostname")
+	port := set.Uint64Long("port", 'p', config.Default_port, "TrueNAS API endpoint port")
+	protocol := set.StringLong("protocol", 0, config.Default_protocol, "websocket protocol, 'ws' or 'wss'")
+	skipVerify := set.BoolLong("tls-skip-verify", 'k', "do not verify the TrueNAS certificate")
+	set.SetProgram("init")
+	if err := set.Getopt(append([]string{"init"}, args...), nil); err != nil {
+		set.PrintUsage(os.Stderr)
+		return err
+	}
+
+	// sections are appended as ini text
+	switch strings.ToLower(filepath.Ext(configFile)) {
+	case ".yaml", ".yml", ".toml":
+		return fmt.Errorf("init appends ini sections, run it on an ini file and use config convert")
+	}
+
+	p := newPrompter(os.Stdin, os.Stdout)
+	var err error
+	if *host == "" {
+		if *host, err = p.ask("TrueNAS hostname", ""); err != nil {
+			return err
+		}
+		if *host == "" {
+			return fmt.Errorf("no hostname given")
+		}
+	}
+	if *name == "" {
+		*name, _, _ = strings.Cut(*host, ".")
+	}
+	if existing, err := config.Sections(configFile); err == nil {
+		for _, s := range existing {
+			if s == *name {
+				return fmt.Errorf("config section %s already exists in %s, use --section", *name, configFile)
+			}
+		}
+	}
+
+	sec := &initSection{name: *name}
+	sec.set("connect_host", *host)
+	if *port != config.Default_port {
+		sec.set("port", strconv.FormatUint(*port, 10))
+	}
+	if *protocol != config.Default_protocol {
+		sec.set("protocol", *protocol)
+	}
+	if *skipVerify {
+		sec.set("tls_skip_verify", "true")
+	}
+
+	// credentials are kept in files next to the config file, never inline
+	dir := filepath.Dir(configFile)
+	method, err := p.ask("Log in with an api_key or a password", "api_key")
+	if err != nil {
+		return err
+	}
+	switch method {
+	case "api_key":
+		path, err := p.askSecretFile("API key file", filepath.Join(dir, *name+".key"), "API key")
+		if err != nil {
+			return err
+		}
+		sec.set("api_key_file", path)
+	case "password":
+		username, err := p.ask("Username", "")
+		if err != nil {
+			return err
+		}
+		sec.set("username", username)
+		path, err := p.askSecretFile("Password file", filepath.Join(dir, *name+".password"), "password")
+		if err != nil {
+			return err
+		}
+		sec.set("password_file", path)
+		if path, err = p.ask("TOTP secret file, empty if two-factor authentication is off", ""); err != nil {
+			return err
+		} else if path != "" {
+			sec.set("otp_secret_file", path)
+		}
+	default:
+		return fmt.Errorf("unknown login method %s", method)
+	}
+
+	fullChain, err := p.ask("Full chain certificate path", "/etc/letsencrypt/live/"+*host+"/fullchain.pem")
+	if err != nil {
+		return err
+	}
+	sec.set("full_chain_path", fullChain)
+	privateKey, err := p.ask("Private key path", filepath.Join(filepath.Dir(fullChain), "privkey.pem"))
+	if err != nil {
+		return err
+	}
+	sec.set("private_key_path", privateKey)
+
+	cfg, err := validateSection(configFile, sec, opts)
+	if err != nil {
+		return err
+	}
+	services, err := discoverServices(cfg)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\nconnected to %s\n", *host)
+	fmt.Printf("  web UI certificate: %s\n", services.UICertificate)
+	if services.FTPTLS {
+		fmt.Printf("  FTP TLS certificate: %s\n", services.FTPCertificate)
+	} else {
+		fmt.Println("  FTP TLS is disabled")
+	}
+	if len(services.Apps) == 0 {
+		fmt.Println("  no apps accept a certificate")
+	}
+	for _, app := range services.Apps {
+		fmt.Printf("  app %s accepts a certificate\n", app.Name)
+	}
+	fmt.Println()
+
+	if ok, err := p.confirm("Use the certificate for the web UI", true); err != nil {
+		return err
+	} else if ok {
+		sec.set("add_as_ui_certificate", "true")
+	}
+	if services.FTPTLS {
+		if ok, err := p.confirm("Use the certificate for FTP", false); err != nil {
+			return err
+		} else if ok {
+			sec.set("add_as_ftp_certificate", "true")
+		}
+	}
+	if len(services.Apps) > 0 {
+		if ok, err := p.confirm("Use the certificate for apps", true); err != nil {
+			return err
+		} else if ok {
+			sec.set("add_as_app_certificate", "true")
+			if len(services.Apps) > 1 {
+				app, err := p.ask("App name, empty for every app listed", "")
+				if err != nil {
+					return err
+				}
+				if app != "" {
+					sec.set("app_name", app)
+				}
+			} else {
+				sec.set("app_name", services.Apps[0].Name)
+			}
+		}
+	}
+	basename, err := p.ask("Certificate basename", suggestBasename(services.Certificates, *name))
+	if err != nil {
+		return err
+	}
+	sec.set("cert_basename", basename)
+
+	if _, err = validateSection(configFile, sec, opts); err != nil {
+		return err
+	}
+	fmt.Printf("\n%s\n", sec)
+	if ok, err := p.confirm("Append this section to "+configFile, true); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("the config file was not changed")
+	}
+	if err = appendSection(configFile, sec); err != nil {
+		return err
+	}
+	log.Printf("added config section %s to %s", sec.name, configFile)
+	return nil
+}
+
+// load the section exactly as the deploy command will, from a copy of the
+// config file with the section appended
+func validateSection(configFile string, sec *initSection, opts config.Options) (*config.Config, error) {
+	existing, err := os.ReadFile(configFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(configFile), ".tnas-cert-init-*.ini")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(sectionAppended(existing, sec))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := config.NewWithOptions(tmp.Name(), sec.name, opts)
+	if err != nil {
+		return nil, fmt.Errorf("the new section is not valid, %v", err)
+	}
+	return cfg, nil
+}
+
+// test the connection and credentials and list the services
+func discoverServices(cfg *config.Config) (*deploy.Services, error) {
+	client, err := truenas_api.NewClient(cfg.ServerURL(), !cfg.TlsSkipVerify)
+	if err != nil {
+		return nil, fmt.Errorf("error creating the client, %v", err)
+	}
+	defer func(client *truenas_api.Client) {
+		if err := client.Close(); err != nil {
+			log.Printf("failed to close the client connection, %v", err)
+		}
+	}(client)
+
+	if err = deploy.Login(client, cfg); err != nil {
+		return nil, err
+	}
+	return deploy.Discover(client, cfg)
+}
+
+// suggest a basename that no installed certificate already starts with, so
+// that certificates of this section are never mistaken for another's
+func suggestBasename(installed []string, section string) string {
+	inUse := func(basename string) bool {
+		for _, name := range installed {
+			if strings.HasPrefix(name, basename) {
+				return true
+			}
+		}
+		return false
+	}
+	basename := config.Default_base_cert_name
+	if !inUse(basename) {
+		return basename
+	}
+	basename = section + "-" + config.Default_base_cert_name
+	for i := 2; inUse(basename); i++ {
+		basename = fmt.Sprintf("%s%d-%s", section, i, config.Default_base_cert_name)
+	}
+	return basename
+}
+
+func sectionAppended(existing []byte, sec *initSection) []byte {
+	data := append([]byte{}, existing...)
+	if len(data) > 0 {
+		if data[len(data)-1] != '\n' {
+			data = append(data, '\n')
+		}
+		data = append(data, '\n')
+	}
+	return append(data, sec.String()...)
+}
+
+// append the section as text so that the comments and layout of the
+// existing file are left as they are
+func appendSection(configFile string, sec *initSection) error {
+	existing, err := os.ReadFile(configFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	data := sectionAppended(existing, sec)[len(existing):]
+	f, err := os.OpenFile(configFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("could not open %s, %v", configFile, err)
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write %s, %v", configFile, err)
+	}
+	return f.Close()
+}
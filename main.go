@@ -18,33 +18,172 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
 	"fmt"
 	"github.com/pborman/getopt/v2"
 	"github.com/truenas/api_client_golang/truenas_api"
 	"log"
 	"os"
 	"runtime/debug"
+	"strings"
+	"tnascert-deploy/certfile"
+	"tnascert-deploy/certsource"
 	"tnascert-deploy/config"
 	"tnascert-deploy/deploy"
+	"tnascert-deploy/hook"
+	"tnascert-deploy/vault"
 )
 
 const release = "1.2"
 
-// simple verification of the certificate and private key, can they be loaded and parsed
-func verifyCertificateKeyPair(cert_path string, key_path string) error {
-	cert, err := tls.LoadX509KeyPair(cert_path, key_path)
+// load the certificate and private key from the section's certificate source,
+// checking the private key file permissions unless disabled, and verify that
+// the pair can be parsed
+func verifyCertificateKeyPair(cfg *config.Config, vc *vault.Client, inputs certsource.Inputs) (*certfile.Bundle, error) {
+	source, err := certsource.New(cfg, vc, inputs)
 	if err != nil {
-		return fmt.Errorf("LoadX509KeyPair error: %v", err)
+		return nil, err
 	}
-	_, err = x509.ParseCertificate(cert.Certificate[0])
+	bundle, err := source.Load()
 	if err != nil {
-		return fmt.Errorf("ParseCertificate error: %v", err)
+		return nil, err
+	}
+	if err = bundle.Verify(); err != nil {
+		return nil, err
+	}
+	if cfg.Debug {
+		log.Printf("loaded the certificate key pair from %s", source)
+	}
+	return bundle, nil
+}
+
+// log in to vault once for both the certificate and the api key, the
+// returned client is nil when the section does not use vault
+func openVault(cfg *config.Config) (*vault.Client, error) {
+	if !cfg.UsesVault() {
+		return nil, nil
+	}
+	vc, err := vault.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.VaultApiKeyPath != "" {
+		cfg.Api_key, err = vc.ReadKVField(cfg.VaultKVMount, cfg.VaultApiKeyPath, cfg.VaultApiKeyField)
+		if err != nil {
+			closeVault(vc)
+			return nil, fmt.Errorf("reading the api key from vault, %v", err)
+		}
+		log.Println("read the api key from vault")
+	}
+	return vc, nil
+}
+
+func closeVault(vc *vault.Client) {
+	if vc == nil {
+		return
+	}
+	if err := vc.Close(); err != nil {
+		log.Printf("failed to close the vault client, %v", err)
+	}
+}
+
+// deploy the certificate key pair configured in a config section, inputs
+// holds the stdin or fd input already read by an earlier section of the run
+func deploySection(cfg *config.Config, inputs certsource.Inputs) error {
+	vc, err := openVault(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeVault(vc)
+
+	// run a simple check of the certificate and private key before deployment.
+	bundle, err := verifyCertificateKeyPair(cfg, vc, inputs)
+	if err != nil {
+		return fmt.Errorf("verifying the certificate key pair, %v", err)
+	}
+	log.Println("verified the certificate key pair")
+
+	serverURL := cfg.ServerURL()
+	client, err := truenas_api.NewClient(serverURL, !cfg.TlsSkipVerify)
+	if err != nil {
+		return fmt.Errorf("error creating the client, %v", err)
+	}
+	defer func(client *truenas_api.Client) {
+		err := client.Close()
+		if err != nil {
+			log.Printf("failed to close the client connection, %v", err)
+		}
+	}(client)
+
+	// deploy the certificate key pair
+	err = deploy.InstallCertificate(client, cfg, bundle)
+	if err != nil {
+		return fmt.Errorf("installing the certificate failed, %v", err)
 	}
 	return nil
 }
 
+// run as a certbot --deploy-hook or acme.sh --reloadcmd, deploying every
+// config section that matches the renewed certificate
+func runHook(configFile string, opts config.Options) error {
+	renewal, err := hook.FromEnv(os.Getenv)
+	if err != nil {
+		return err
+	}
+	log.Printf("renewal hook called for %s", renewal)
+
+	sections, err := config.Sections(configFile)
+	if err != nil {
+		return fmt.Errorf("error loading config, %v", err)
+	}
+
+	var matched int
+	var failed []string
+	inputs := certsource.Inputs{}
+	for _, section := range sections {
+		cfg, err := config.NewWithOptions(configFile, section, opts)
+		if err != nil {
+			log.Printf("skipping config section %s, %v", section, err)
+			continue
+		}
+		if !renewal.Matches(cfg) {
+			continue
+		}
+		matched++
+		log.Printf("deploying config section %s", section)
+		if err = deploySection(cfg, inputs); err != nil {
+			log.Printf("config section %s failed, %v", section, err)
+			failed = append(failed, section)
+		}
+	}
+
+	// the ACME client may renew certificates that are not deployed to TrueNAS
+	if matched == 0 {
+		log.Printf("no config section matches the %s, nothing to deploy", renewal)
+		return nil
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("deployment failed for config sections: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// the --set flags, unlike a getopt list each value is kept whole so that a
+// value may hold commas
+type overrideFlags []string
+
+func (o *overrideFlags) Set(value string, opt getopt.Option) error {
+	if value == "" {
+		*o = nil
+		return nil
+	}
+	*o = append(*o, value)
+	return nil
+}
+
+func (o *overrideFlags) String() string {
+	return strings.Join(*o, " ")
+}
+
 func main() {
 	var section string = config.Default_section
 
@@ -52,7 +191,11 @@ func main() {
 	configFile := getopt.StringLong("config", 'c', config.Config_file, "full path to the configuration file")
 	help := getopt.BoolLong("help", 'h', "print usage information and exit")
 	version := getopt.BoolLong("version", 'v', "print version information and exit")
-	getopt.SetParameters("ini_section_name")
+	identity := getopt.StringLong("identity", 'i', "", "age identity file used to decrypt ENC[age:...] values, defaults to $"+config.IdentityEnv)
+	var overrides overrideFlags
+	getopt.FlagLong(&overrides, "set", 's', "override a setting of the section, key=value, may be repeated")
+	appParallel := getopt.IntLong("app-parallel", 0, 0, "the number of apps updated at the same time, the same as --set app_parallel=N", "N")
+	getopt.SetParameters("[hook | init | doctor [ini_section_name] | validate [ini_section_name...] | config encrypt|decrypt|convert|schema | ini_section_name]")
 
 	getopt.Parse()
 	if *help == true {
@@ -69,41 +212,53 @@ func main() {
 			}
 		}
 	}
+	if *appParallel > 0 {
+		overrides = append(overrides, fmt.Sprintf("app_parallel=%d", *appParallel))
+	}
+	opts := config.Options{IdentityFile: *identity, Set: overrides}
+
 	args := getopt.Args()
+	if len(args) > 0 && args[0] == "hook" {
+		if err := runHook(*configFile, opts); err != nil {
+			log.Fatalln("renewal hook failed,", err)
+		}
+		os.Exit(0)
+	}
+	if len(args) > 0 && args[0] == "init" {
+		if err := runInit(args[1:], *configFile, opts); err != nil {
+			log.Fatalln("init failed,", err)
+		}
+		os.Exit(0)
+	}
+	if len(args) > 0 && args[0] == "doctor" {
+		if err := runDoctor(args[1:], *configFile, opts); err != nil {
+			log.Fatalln("doctor failed,", err)
+		}
+		os.Exit(0)
+	}
+	if len(args) > 0 && args[0] == "validate" {
+		if err := runValidate(args[1:], *configFile, opts); err != nil {
+			log.Fatalln(err)
+		}
+		os.Exit(0)
+	}
+	if len(args) > 0 && args[0] == "config" {
+		if err := runConfigCommand(args[1:], *configFile, opts); err != nil {
+			log.Fatalln(err)
+		}
+		os.Exit(0)
+	}
 	if len(args) > 0 {
 		section = args[0]
 	}
 
-	cfg, err := config.New(*configFile, section)
+	cfg, err := config.NewWithOptions(*configFile, section, opts)
 	if err != nil {
 		getopt.PrintUsage(os.Stdout)
 		log.Fatalln("error loading config,", err)
 	}
 
-	// run a simple check of the certificate and private key before deployment.
-	err = verifyCertificateKeyPair(cfg.FullChainPath, cfg.Private_key_path)
-	if err != nil {
-		log.Fatalf("verifying the certificate key pair, %v", err)
-	} else {
-		log.Println("verified the certificate key pair")
-	}
-
-	serverURL := cfg.ServerURL()
-	client, err := truenas_api.NewClient(serverURL, cfg.TlsSkipVerify)
-	if err != nil {
-		log.Println("error creating the client,", err)
-		os.Exit(1)
-	}
-	defer func(client *truenas_api.Client) {
-		err := client.Close()
-		if err != nil {
-			log.Printf("failed to close the client connection, %v", err)
-		}
-	}(client)
-
-	// deploy the certificate key pair
-	err = deploy.InstallCertificate(client, cfg)
-	if err != nil {
-		log.Printf("installing the certificate failed, %v", err)
+	if err = deploySection(cfg, nil); err != nil {
+		log.Fatalln(err)
 	}
 }
@@ -1,7 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"tnascert-deploy/config"
 )
@@ -14,10 +21,101 @@ func TestMainPackage(t *testing.T) {
 		t.Fatalf("New config failed with error: %v", err)
 	}
 
-	err = verifyCertificateKeyPair(cfg.FullChainPath, cfg.Private_key_path)
+	_, err = verifyCertificateKeyPair(cfg, nil, nil)
 	if err != nil {
 		t.Fatalf("verifying the certificate key pair, %v", err)
 	} else {
 		fmt.Println("verified the certificate key pair")
 	}
 }
+
+func TestInitSection(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "tnas-cert.ini")
+	original := "# certificates for the lab\n[nas01] ; the first NAS\nconnect_host = nas01.mydomain.com"
+	if err := os.WriteFile(configFile, []byte(original), 0o600); err != nil {
+		t.Fatalf("writing the config failed with error: %v", err)
+	}
+
+	sec := &initSection{name: "nas04"}
+	sec.set("connect_host", "nas04.mydomain.com")
+	sec.set("full_chain_path", "test_files/fullchain.pem")
+	sec.set("private_key_path", "test_files/privkey.pem")
+	sec.set("skip_permission_checks", "true")
+	sec.set("api_key", "test")
+	if _, err := validateSection(configFile, sec, config.Options{}); err != nil {
+		t.Fatalf("validateSection failed with error: %v", err)
+	}
+	sec.set("protocol", "http")
+	if _, err := validateSection(configFile, sec, config.Options{}); err == nil {
+		t.Errorf("validateSection should refuse an invalid protocol")
+	}
+	sec.set("protocol", "wss")
+
+	// the section is appended and the existing text left as it was
+	if err := appendSection(configFile, sec); err != nil {
+		t.Fatalf("appendSection failed with error: %v", err)
+	}
+	data, _ := os.ReadFile(configFile)
+	if !strings.HasPrefix(string(data), original+"\n\n[nas04]\n") {
+		t.Errorf("unexpected config file:\n%s", data)
+	}
+	if cfg, err := config.New(configFile, "nas04"); err != nil || cfg.ConnectHost != "nas04.mydomain.com" {
+		t.Errorf("loading the appended section failed with error: %v", err)
+	}
+
+	if name := suggestBasename([]string{"truenas_default"}, "nas04"); name != config.Default_base_cert_name {
+		t.Errorf("unexpected basename %s", name)
+	}
+	installed := []string{"tnas-cert-deploy-2024-12-31-0801683628", "nas04-tnas-cert-deploy-2025-01-01-1735689600"}
+	if name := suggestBasename(installed, "nas04"); name != "nas042-tnas-cert-deploy" {
+		t.Errorf("unexpected basename %s", name)
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	configFile := filepath.Join(t.TempDir(), "tnas-cert.ini")
+	data := fmt.Sprintf("[nas01]\nconnect_host = %s\nport = %s\ntls_skip_verify = true\napi_key = test\nskip_permission_checks = true\n"+
+		"full_chain_path = %s\nprivate_key_path = %s\n", host, port, "test_files/fullchain.pem", "test_files/privkey.pem")
+	if err := os.WriteFile(configFile, []byte(data), 0o600); err != nil {
+		t.Fatalf("writing the config failed with error: %v", err)
+	}
+
+	report := diagnose(configFile, "nas01", config.Options{})
+	status := map[string]string{}
+	for _, stage := range report.Stages {
+		status[stage.Name] = stage.Status
+	}
+	// the test server has a self signed certificate and does not speak websocket
+	want := map[string]string{"config": stageOK, "dns": stageOK, "tcp": stageOK,
+		"tls": stageWarning, "websocket": stageFailed, "login": stageSkipped, "clock": stageSkipped}
+	for name, s := range want {
+		if status[name] != s {
+			t.Errorf("stage %s is %s, want %s", name, status[name], s)
+		}
+	}
+	// the test certificate may have expired, which is only a warning
+	if status["certificate"] == stageFailed {
+		t.Errorf("the certificate stage failed")
+	}
+	if report.OK {
+		t.Errorf("the report should not be OK")
+	}
+	if _, err := json.Marshal(report); err != nil {
+		t.Errorf("the report could not be encoded as JSON, %v", err)
+	}
+
+	report = diagnose(configFile, "missing", config.Options{})
+	if len(report.Stages) != 1 || report.Stages[0].Status != stageFailed {
+		t.Errorf("a missing section should fail the config stage")
+	}
+
+	for _, datetime := range []string{`{"$date": 1700000000000}`, `"2023-11-14T22:13:20Z"`} {
+		if when, err := parseDatetime(json.RawMessage(datetime)); err != nil || when.Unix() != 1700000000 {
+			t.Errorf("parseDatetime(%s) returned %v, %v", datetime, when, err)
+		}
+	}
+}
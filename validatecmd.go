@@ -0,0 +1,62 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"tnascert-deploy/config"
+)
+
+// the validate command: check the named sections, or every section, report
+// all the problems found and print the effective config of valid sections
+func runValidate(args []string, configFile string, opts config.Options) error {
+	reports, err := config.Validate(configFile, args, opts)
+	if err != nil {
+		return fmt.Errorf("error loading config, %v", err)
+	}
+	if invalid := printValidation(os.Stdout, reports); invalid > 0 {
+		return fmt.Errorf("%d of %d config sections are not valid", invalid, len(reports))
+	}
+	return nil
+}
+
+// print the reports and return the number of sections with errors
+func printValidation(w io.Writer, reports []*config.SectionReport) int {
+	var invalid int
+	for _, report := range reports {
+		if len(report.Errors) > 0 {
+			invalid++
+			fmt.Fprintf(w, "%s: %d errors\n", report.Section, len(report.Errors))
+		} else {
+			fmt.Fprintf(w, "%s: ok\n", report.Section)
+		}
+		for _, e := range report.Errors {
+			fmt.Fprintf(w, "  error: %s\n", e)
+		}
+		for _, warning := range report.Warnings {
+			fmt.Fprintf(w, "  warning: %s\n", warning)
+		}
+		if report.Config != nil {
+			fmt.Fprintf(w, "\n%s", report.Config.Effective(report.Section))
+		}
+		fmt.Fprintln(w)
+	}
+	return invalid
+}
@@ -0,0 +1,309 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/*
+ * A minimal HashiCorp Vault HTTP API client, just enough to read KV v2
+ * secrets and issue PKI certificates.
+ */
+
+package vault
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"tnascert-deploy/config"
+)
+
+// a renewable token with less time than this left is renewed after login
+const minTokenTTL = 5 * time.Minute
+
+// Client talks to the Vault HTTP API on behalf of one config section
+type Client struct {
+	addr      string
+	namespace string
+	token     string
+	ownToken  bool // the token was issued to us by a login and is revoked on Close
+	debug     bool
+	http      *http.Client
+}
+
+// Secret is the common envelope of Vault API responses
+type Secret struct {
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int64                  `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int64  `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// Certificate is a certificate, its chain and private key read from Vault
+type Certificate struct {
+	Certificate string
+	Chain       string
+	PrivateKey  string
+	LeaseID     string
+}
+
+// New connects to Vault with the auth method configured in the section
+func New(cfg *config.Config) (*Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.VaultCAFile != "" {
+		ca, err := os.ReadFile(cfg.VaultCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read vault_ca_file, %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in vault_ca_file %s", cfg.VaultCAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	c := &Client{
+		addr:      strings.TrimSuffix(cfg.VaultAddr, "/"),
+		namespace: cfg.VaultNamespace,
+		debug:     cfg.Debug,
+		http:      &http.Client{Transport: transport, Timeout: time.Duration(cfg.TimeoutSeconds) * time.Second},
+	}
+	if err := c.login(cfg); err != nil {
+		return nil, fmt.Errorf("vault login failed, %v", err)
+	}
+	return c, nil
+}
+
+func (c *Client) login(cfg *config.Config) error {
+	switch cfg.VaultAuth {
+	case config.VaultAuthAppRole:
+		secretID := cfg.VaultSecretID
+		if cfg.VaultSecretIDFile != "" {
+			data, err := os.ReadFile(cfg.VaultSecretIDFile)
+			if err != nil {
+				return fmt.Errorf("could not read vault_secret_id_file, %v", err)
+			}
+			secretID = strings.TrimSpace(string(data))
+		}
+		body := map[string]string{"role_id": cfg.VaultRoleID, "secret_id": secretID}
+		secret, err := c.request(http.MethodPost, "auth/"+cfg.VaultApproleMount+"/login", body)
+		if err != nil {
+			return err
+		}
+		if secret.Auth == nil || secret.Auth.ClientToken == "" {
+			return fmt.Errorf("no client token in the approle login response")
+		}
+		c.token = secret.Auth.ClientToken
+		c.ownToken = true
+		log.Printf("logged in to vault with approle, token ttl %ds", secret.Auth.LeaseDuration)
+		return nil
+	case config.VaultAuthTokenFile:
+		path := cfg.VaultTokenFile
+		if path == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return err
+			}
+			path = filepath.Join(home, ".vault-token")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("could not read the vault token file, %v", err)
+		}
+		c.token = strings.TrimSpace(string(data))
+	default:
+		c.token = cfg.VaultToken
+		if c.token == "" {
+			c.token = os.Getenv("VAULT_TOKEN")
+		}
+	}
+	if c.token == "" {
+		return fmt.Errorf("no vault token")
+	}
+	return c.renewIfNeeded()
+}
+
+// renewIfNeeded renews a renewable token that is close to expiring, so that
+// it outlives the deployment
+func (c *Client) renewIfNeeded() error {
+	secret, err := c.request(http.MethodGet, "auth/token/lookup-self", nil)
+	if err != nil {
+		return err
+	}
+	ttl, _ := secret.Data["ttl"].(float64)
+	renewable, _ := secret.Data["renewable"].(bool)
+	// a ttl of zero is a token that never expires
+	if ttl == 0 || !renewable || time.Duration(ttl)*time.Second >= minTokenTTL {
+		return nil
+	}
+	body := map[string]string{"increment": minTokenTTL.String()}
+	if _, err = c.request(http.MethodPost, "auth/token/renew-self", body); err != nil {
+		return fmt.Errorf("renewing the vault token failed, %v", err)
+	}
+	log.Printf("renewed the vault token, it had %.0fs left", ttl)
+	return nil
+}
+
+// ReadKV reads a secret from a KV v2 secrets engine
+func (c *Client) ReadKV(mount string, path string) (map[string]interface{}, error) {
+	secret, err := c.request(http.MethodGet, mount+"/data/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s/%s failed, %v", mount, path, err)
+	}
+	data, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("reading %s/%s failed, no data in the response", mount, path)
+	}
+	return data, nil
+}
+
+// ReadKVField reads a single string field of a KV v2 secret
+func (c *Client) ReadKVField(mount string, path string, field string) (string, error) {
+	data, err := c.ReadKV(mount, path)
+	if err != nil {
+		return "", err
+	}
+	value, ok := data[field].(string)
+	if !ok || value == "" {
+		return "", fmt.Errorf("field %s not found in %s/%s", field, mount, path)
+	}
+	return value, nil
+}
+
+// ReadCertificate reads a certificate stored in the certificate, private_key
+// and optional chain fields of a KV v2 secret
+func (c *Client) ReadCertificate(mount string, path string) (*Certificate, error) {
+	data, err := c.ReadKV(mount, path)
+	if err != nil {
+		return nil, err
+	}
+	cert := &Certificate{}
+	cert.Certificate, _ = data["certificate"].(string)
+	cert.PrivateKey, _ = data["private_key"].(string)
+	cert.Chain, _ = data["chain"].(string)
+	if cert.Certificate == "" || cert.PrivateKey == "" {
+		return nil, fmt.Errorf("%s/%s must hold certificate and private_key fields", mount, path)
+	}
+	return cert, nil
+}
+
+// IssueCertificate issues a new certificate from a PKI issue endpoint such as pki/issue/<role>
+func (c *Client) IssueCertificate(path string, commonName string, altNames []string, ttl string) (*Certificate, error) {
+	body := map[string]string{"common_name": commonName}
+	if len(altNames) > 0 {
+		body["alt_names"] = strings.Join(altNames, ",")
+	}
+	if ttl != "" {
+		body["ttl"] = ttl
+	}
+	secret, err := c.request(http.MethodPost, path, body)
+	if err != nil {
+		return nil, fmt.Errorf("issuing a certificate from %s failed, %v", path, err)
+	}
+
+	cert := &Certificate{LeaseID: secret.LeaseID}
+	cert.Certificate, _ = secret.Data["certificate"].(string)
+	cert.PrivateKey, _ = secret.Data["private_key"].(string)
+	if chain, ok := secret.Data["ca_chain"].([]interface{}); ok {
+		var pems []string
+		for _, ca := range chain {
+			if s, ok := ca.(string); ok {
+				pems = append(pems, s)
+			}
+		}
+		cert.Chain = strings.Join(pems, "\n")
+	} else {
+		cert.Chain, _ = secret.Data["issuing_ca"].(string)
+	}
+	if cert.Certificate == "" || cert.PrivateKey == "" {
+		return nil, fmt.Errorf("issuing a certificate from %s failed, no certificate in the response", path)
+	}
+	if cert.LeaseID != "" && c.debug {
+		log.Printf("issued a certificate from %s with lease %s", path, cert.LeaseID)
+	}
+	return cert, nil
+}
+
+// Close releases the token obtained by an approle login. Certificate leases
+// are left alone, revoking them would revoke the certificate being deployed.
+func (c *Client) Close() error {
+	if !c.ownToken {
+		return nil
+	}
+	if _, err := c.request(http.MethodPost, "auth/token/revoke-self", nil); err != nil {
+		return fmt.Errorf("revoking the vault token failed, %v", err)
+	}
+	c.token, c.ownToken = "", false
+	return nil
+}
+
+func (c *Client) request(method string, path string, body interface{}) (*Secret, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.addr+"/v1/"+strings.TrimPrefix(path, "/"), reader)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Vault-Token", c.token)
+	}
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var secret Secret
+	if resp.StatusCode == http.StatusNoContent {
+		return &secret, nil
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&secret); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("could not parse the vault response, %v", err)
+	}
+	if resp.StatusCode >= 400 {
+		if len(secret.Errors) > 0 {
+			return nil, fmt.Errorf("vault returned %s: %s", resp.Status, strings.Join(secret.Errors, ", "))
+		}
+		return nil, fmt.Errorf("vault returned %s", resp.Status)
+	}
+	return &secret, nil
+}
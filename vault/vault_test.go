@@ -0,0 +1,212 @@
+/*
+ * Copyright (C) 2025 by John J. Rushford jrushford@apache.org
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vault
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"tnascert-deploy/config"
+)
+
+// a local stand-in for the parts of the Vault HTTP API used by the client
+type fakeVault struct {
+	mu      sync.Mutex
+	tokens  map[string]float64 // token to ttl seconds
+	renewed int
+	revoked []string
+}
+
+func (f *fakeVault) reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var body map[string]string
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+
+	if r.URL.Path == "/v1/auth/approle/login" {
+		if body["role_id"] != "role" || body["secret_id"] != "secret" {
+			f.reply(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{"invalid role or secret ID"}})
+			return
+		}
+		f.tokens["approle-token"] = 3600
+		f.reply(w, http.StatusOK, map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": "approle-token", "lease_duration": 3600, "renewable": true},
+		})
+		return
+	}
+
+	token := r.Header.Get("X-Vault-Token")
+	ttl, ok := f.tokens[token]
+	if !ok {
+		f.reply(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v1/auth/token/lookup-self":
+		f.reply(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"ttl": ttl, "renewable": true}})
+	case "/v1/auth/token/renew-self":
+		f.renewed++
+		f.tokens[token] = 300
+		f.reply(w, http.StatusOK, map[string]interface{}{"auth": map[string]interface{}{"client_token": token}})
+	case "/v1/auth/token/revoke-self":
+		f.revoked = append(f.revoked, token)
+		delete(f.tokens, token)
+		w.WriteHeader(http.StatusNoContent)
+	case "/v1/secret/data/tnas/nas01":
+		f.reply(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"data": map[string]interface{}{"certificate": "CERT", "private_key": "KEY", "chain": "CHAIN", "api_key": "1-abcdef"},
+		}})
+	case "/v1/pki/issue/truenas":
+		if body["common_name"] != "nas01.mydomain.com" {
+			f.reply(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{"common name not allowed"}})
+			return
+		}
+		f.reply(w, http.StatusOK, map[string]interface{}{
+			"lease_id": "pki/issue/truenas/abc",
+			"data": map[string]interface{}{
+				"certificate": "CERT", "private_key": "KEY", "ca_chain": []string{"INTERMEDIATE", "ROOT"},
+			},
+		})
+	default:
+		f.reply(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+	}
+}
+
+func newFakeVault(t *testing.T) (*fakeVault, *httptest.Server) {
+	f := &fakeVault{tokens: map[string]float64{"user-token": 60, "root-token": 0}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func TestTokenAuth(t *testing.T) {
+	f, server := newFakeVault(t)
+	cfg := &config.Config{TimeoutSeconds: 10}
+	cfg.VaultAddr = server.URL
+	cfg.VaultAuth = config.VaultAuthToken
+	cfg.VaultToken = "user-token"
+
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New failed with error: %v", err)
+	}
+	// the token had 60 seconds left and must have been renewed
+	if f.renewed != 1 {
+		t.Errorf("the token should have been renewed once, renewed %d times", f.renewed)
+	}
+
+	cert, err := c.ReadCertificate("secret", "tnas/nas01")
+	if err != nil {
+		t.Fatalf("ReadCertificate failed with error: %v", err)
+	}
+	if cert.Certificate != "CERT" || cert.PrivateKey != "KEY" || cert.Chain != "CHAIN" {
+		t.Errorf("unexpected certificate %+v", cert)
+	}
+	key, err := c.ReadKVField("secret", "tnas/nas01", "api_key")
+	if err != nil || key != "1-abcdef" {
+		t.Errorf("ReadKVField returned %s, %v", key, err)
+	}
+	if _, err = c.ReadKVField("secret", "tnas/nas01", "missing"); err == nil {
+		t.Errorf("ReadKVField should fail for a missing field")
+	}
+
+	// a token we did not create must not be revoked
+	if err = c.Close(); err != nil {
+		t.Errorf("Close failed with error: %v", err)
+	}
+	if len(f.revoked) != 0 {
+		t.Errorf("a configured token should not be revoked")
+	}
+
+	cfg.VaultToken = "bad-token"
+	if _, err = New(cfg); err == nil {
+		t.Errorf("New should fail with an invalid token")
+	}
+}
+
+func TestTokenFileAuth(t *testing.T) {
+	f, server := newFakeVault(t)
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("root-token\n"), 0o600); err != nil {
+		t.Fatalf("writing the token file failed with error: %v", err)
+	}
+	cfg := &config.Config{TimeoutSeconds: 10}
+	cfg.VaultAddr = server.URL
+	cfg.VaultAuth = config.VaultAuthTokenFile
+	cfg.VaultTokenFile = path
+
+	if _, err := New(cfg); err != nil {
+		t.Fatalf("New failed with error: %v", err)
+	}
+	// a token without a ttl never expires and is not renewed
+	if f.renewed != 0 {
+		t.Errorf("a token without a ttl should not be renewed")
+	}
+}
+
+func TestAppRoleAuth(t *testing.T) {
+	f, server := newFakeVault(t)
+	cfg := &config.Config{TimeoutSeconds: 10}
+	cfg.VaultAddr = server.URL
+	cfg.VaultAuth = config.VaultAuthAppRole
+	cfg.VaultApproleMount = "approle"
+	cfg.VaultRoleID = "role"
+	cfg.VaultSecretID = "secret"
+
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New failed with error: %v", err)
+	}
+	cert, err := c.IssueCertificate("pki/issue/truenas", "nas01.mydomain.com", nil, "72h")
+	if err != nil {
+		t.Fatalf("IssueCertificate failed with error: %v", err)
+	}
+	if cert.Chain != "INTERMEDIATE\nROOT" || cert.LeaseID != "pki/issue/truenas/abc" {
+		t.Errorf("unexpected certificate %+v", cert)
+	}
+	if _, err = c.IssueCertificate("pki/issue/truenas", "other.mydomain.com", nil, ""); err == nil {
+		t.Errorf("IssueCertificate should fail for a rejected common name")
+	}
+
+	// the approle token is ours and must be released
+	if err = c.Close(); err != nil {
+		t.Errorf("Close failed with error: %v", err)
+	}
+	if len(f.revoked) != 1 || f.revoked[0] != "approle-token" {
+		t.Errorf("the approle token should have been revoked, revoked %v", f.revoked)
+	}
+
+	cfg.VaultSecretID = "wrong"
+	if _, err = New(cfg); err == nil {
+		t.Errorf("New should fail with the wrong secret_id")
+	}
+}